@@ -17,14 +17,19 @@ package cache
 
 import (
 	"bufio"
+	"context"
 	"crypto/md5"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 
+	"github.com/aws/amazon-ecs-init/ecs-init/cache/filecache"
 	"github.com/aws/amazon-ecs-init/ecs-init/config"
+	"github.com/aws/amazon-ecs-init/ecs-init/sigverify"
 	log "github.com/cihub/seelog"
 )
 
@@ -34,16 +39,71 @@ const (
 
 // Downloader is resposible for cache operations relating to downloading the agent
 type Downloader struct {
-	getter httpGetter
-	fs     fileSystem
+	getter   httpGetter
+	fs       fileSystem
+	registry *RegistryDownloader
+	caches   *filecache.Manager
+	// Progress, if set, receives the percent-complete (0-100) of the
+	// in-flight tarball download. Sends are non-blocking: a caller that
+	// does not read from it simply does not see progress updates.
+	Progress chan int
 }
 
 // NewDownloader returns a Downloader with default dependencies
 func NewDownloader() *Downloader {
-	return &Downloader{
-		getter: customGetter,
-		fs:     &standardFS{},
+	d := &Downloader{
+		getter:   customGetter,
+		fs:       &standardFS{},
+		registry: NewRegistryDownloader(),
 	}
+	d.caches = newCacheManager(d.fs)
+	return d
+}
+
+// desiredCacheDir holds artifacts for an Agent image that has been
+// downloaded but not yet promoted to current, kept separate from
+// config.CacheDirectory() itself so pruning it on a timer can never reach
+// the cache-state marker, the desired-image locator file, or the
+// compat-shim tarball that also live at that top level.
+func desiredCacheDir() string {
+	return filepath.Join(config.CacheDirectory(), "desired")
+}
+
+// newCacheManager declares the named caches ecs-init keeps on disk: the
+// downloaded Agent blobs, the desired (not yet promoted) image artifacts,
+// imported GPG keyrings, and detached signatures. Age and size limits are operator configurable
+// via ECS_CACHE_MAX_AGE and ECS_CACHE_MAX_SIZE so instances can keep the
+// last few Agent versions for rollback without unbounded disk growth. The
+// "agent" cache's entries are pinned against eviction while still
+// referenced by the current, desired, or previous ref, so a prune pass can
+// never delete the blob backing a running or about-to-run Agent.
+func newCacheManager(fs fileSystem) *filecache.Manager {
+	maxAge := config.CacheMaxAge()
+	maxSize := config.CacheMaxSizeBytes()
+	return filecache.NewManager(
+		&filecache.Cache{
+			Name:         "agent",
+			Dir:          blobsDir(),
+			MaxAge:       maxAge,
+			MaxSizeBytes: maxSize,
+			Pinned:       func(name string) bool { return isReferencedBlob(fs, name) },
+		},
+		&filecache.Cache{Name: "desired", Dir: desiredCacheDir(), MaxAge: maxAge},
+		&filecache.Cache{Name: "gpg", Dir: filepath.Join(config.CacheDirectory(), "gpg"), MaxAge: maxAge},
+		&filecache.Cache{Name: "signatures", Dir: signaturesDir(), MaxAge: maxAge},
+	)
+}
+
+// Prune removes cache entries that have exceeded their configured MaxAge or
+// pushed their cache over its MaxSizeBytes, then garbage collects any blob
+// left unreferenced afterwards. It is safe to call while a download is in
+// progress and is intended to be invoked periodically by the init
+// supervisor loop.
+func (d *Downloader) Prune(ctx context.Context) error {
+	if err := d.caches.Prune(ctx); err != nil {
+		return err
+	}
+	return d.GarbageCollect()
 }
 
 // IsAgentCached returns true if there is a cached copy of the Agent present
@@ -62,60 +122,183 @@ func (d *Downloader) fileNotEmpty(filename string) bool {
 }
 
 // DownloadAgent downloads a fresh copy of the Agent and performs an
-// integrity check on the downloaded image
+// integrity check on the downloaded image. When config.AgentRegistryEndpoint()
+// is set, the Agent image is pulled directly from an OCI/Docker registry;
+// otherwise it falls back to the S3-published tarball.
 func (d *Downloader) DownloadAgent() error {
 	err := d.fs.MkdirAll(config.CacheDirectory(), os.ModeDir|orwPerm)
 	if err != nil {
 		return err
 	}
 
-	publishedMd5Sum, err := d.getPublishedMd5Sum()
-	if err != nil {
-		return err
+	if config.AgentRegistryEndpoint() != "" {
+		if err = d.registry.Pull(); err != nil {
+			log.Warnf("Failed to pull Agent image from registry, falling back to tarball download: %v", err)
+		} else {
+			return nil
+		}
 	}
 
-	publishedTarballReader, err := d.getPublishedTarball()
+	publishedSum, usingSha256, err := d.getPublishedChecksum()
 	if err != nil {
 		return err
 	}
-	defer publishedTarballReader.Close()
 
+	// The blob is always content-addressed by sha256 regardless of which
+	// checksum we verify it against, so both hashes are computed together
+	// and only the one matching what the server published is checked. Both
+	// are resumable: downloadTarballResumable rehydrates them from a
+	// checkpoint left by a previous, interrupted attempt instead of
+	// rehashing from zero.
+	sha256hash := sha256.New()
 	md5hash := md5.New()
-	tempFile, err := d.fs.TempFile("", "ecs-agent.tar")
+	tempFile, err := d.downloadTarballResumable(sha256hash, md5hash)
 	if err != nil {
 		return err
 	}
-	log.Debugf("Temp file %s", tempFile.Name())
+	log.Debugf("Downloaded to %s", tempFile.Name())
 	defer func() {
 		if err != nil {
-			log.Debugf("Removing temp file %s", tempFile.Name())
+			log.Debugf("Removing partial download %s", tempFile.Name())
 			d.fs.Remove(tempFile.Name())
+			d.fs.Remove(progressCheckpointPath())
 		}
 	}()
 	defer tempFile.Close()
 
-	teeReader := d.fs.TeeReader(publishedTarballReader, md5hash)
-	_, err = d.fs.Copy(tempFile, teeReader)
+	var calculatedSum string
+	var mismatchErr error
+	if usingSha256 {
+		calculatedSum = fmt.Sprintf("%x", sha256hash.Sum(nil))
+		mismatchErr = fmt.Errorf("mismatched sha256sum while downloading %s", config.AgentRemoteTarball())
+	} else {
+		calculatedSum = fmt.Sprintf("%x", md5hash.Sum(nil))
+		mismatchErr = fmt.Errorf("mismatched md5sum while downloading %s", config.AgentRemoteTarball())
+	}
+	log.Debugf("Expected %s", publishedSum)
+	log.Debugf("Calculated %s", calculatedSum)
+	if publishedSum != calculatedSum {
+		err = mismatchErr
+		return err
+	}
+
+	digest := fmt.Sprintf("sha256:%x", sha256hash.Sum(nil))
+	if err = verifyAndPersistSignature(d.getter, d.fs, digest); err != nil {
+		return err
+	}
+
+	blobDest, err := blobPath(digest)
 	if err != nil {
 		return err
 	}
+	if err = d.fs.MkdirAll(blobsDir(), os.ModeDir|orwPerm); err != nil {
+		return err
+	}
+	// Held for the blob's write-then-rename so a concurrent Prune pass (which
+	// only ever removes a blob via the same tryLock-guarded path) can never
+	// race the rename and remove a partially-written blob.
+	lock, err := filecache.Lock(blobDest)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
 
-	calculatedMd5Sum := md5hash.Sum(nil)
-	calculatedMd5SumString := fmt.Sprintf("%x", calculatedMd5Sum)
-	log.Debugf("Expected %s", publishedMd5Sum)
-	log.Debugf("Calculated %s", calculatedMd5SumString)
-	if publishedMd5Sum != calculatedMd5SumString {
-		err = fmt.Errorf("mismatched md5sum while downloading %s", config.AgentRemoteTarball())
+	if err = writeBlob(d.fs, tempFile.Name(), digest); err != nil {
+		return err
+	}
+	if err = writeRef(d.fs, refDesired, digest); err != nil {
 		return err
 	}
+	d.fs.Remove(progressCheckpointPath())
+	return d.populateCompatAgentTarball(digest)
+}
+
+// verifyAndPersistSignature fetches the detached signature published
+// alongside the Agent image and verifies it against config's trusted keys,
+// rejecting the download if it is missing or invalid. The signature is
+// cached next to the blob so LoadCachedAgent can re-verify it without
+// network access, guarding against on-disk tampering between reboots. Set
+// ECS_SKIP_SIGNATURE_VERIFICATION=true to bypass this check. It is a free
+// function, rather than a method on *Downloader, so RegistryDownloader.Pull
+// can reuse it too: both are the only two places an Agent digest is ever
+// accepted into the cache.
+func verifyAndPersistSignature(getter httpGetter, fs fileSystem, digest string) error {
+	if config.SkipSignatureVerification() {
+		log.Warnf("Skipping Agent signature verification because ECS_SKIP_SIGNATURE_VERIFICATION is set")
+		return nil
+	}
 
-	log.Debugf("Attempting to rename %s to %s", tempFile.Name(), config.AgentTarball())
-	return d.fs.Rename(tempFile.Name(), config.AgentTarball())
+	resp, err := getter.Get(config.AgentRemoteTarballSig())
+	if err != nil {
+		return fmt.Errorf("fetching Agent signature: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response code %d fetching Agent signature", resp.StatusCode)
+	}
+	sig, err := fs.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if err := sigverify.Verify(digest, sig); err != nil {
+		return fmt.Errorf("Agent signature verification failed: %v", err)
+	}
+
+	if err := fs.MkdirAll(signaturesDir(), os.ModeDir|orwPerm); err != nil {
+		return err
+	}
+	return fs.WriteFile(signaturePath(digest), sig, orwPerm)
+}
+
+// populateCompatAgentTarball copies the blob for digest to
+// config.AgentTarball() so that code (and operators) still relying on the
+// single fixed-path tarball keep working for one release cycle.
+func (d *Downloader) populateCompatAgentTarball(digest string) error {
+	path, err := blobPath(digest)
+	if err != nil {
+		return err
+	}
+	src, err := d.fs.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := d.fs.TempFile("", "ecs-agent-compat.tar")
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	if _, err := d.fs.Copy(dst, src); err != nil {
+		d.fs.Remove(dst.Name())
+		return err
+	}
+	return d.fs.Rename(dst.Name(), config.AgentTarball())
+}
+
+// getPublishedChecksum fetches the checksum to verify the downloaded
+// tarball against, preferring the published sha256sum over the legacy
+// md5sum when both are available. It returns the checksum and whether it
+// is a sha256 sum.
+func (d *Downloader) getPublishedChecksum() (string, bool, error) {
+	sum, err := d.getPublishedSum(config.AgentRemoteTarballSHA256())
+	if err == nil {
+		return sum, true, nil
+	}
+	log.Debugf("No published sha256sum available (%v), falling back to md5sum", err)
+
+	sum, err = d.getPublishedSum(config.AgentRemoteTarballMD5())
+	if err != nil {
+		return "", false, err
+	}
+	return sum, false, nil
 }
 
-func (d *Downloader) getPublishedMd5Sum() (string, error) {
-	log.Debugf("Downloading published md5sum from %s", config.AgentRemoteTarballMD5())
-	resp, err := d.getter.Get(config.AgentRemoteTarballMD5())
+func (d *Downloader) getPublishedSum(url string) (string, error) {
+	log.Debugf("Downloading published checksum from %s", url)
+	resp, err := d.getter.Get(url)
 	if err != nil {
 		return "", err
 	}
@@ -124,6 +307,9 @@ func (d *Downloader) getPublishedMd5Sum() (string, error) {
 			resp.Body.Close()
 		}
 	}()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected response code %d fetching %s", resp.StatusCode, url)
+	}
 	body, err := d.fs.ReadAll(resp.Body)
 	if err != nil {
 		return "", err
@@ -131,24 +317,55 @@ func (d *Downloader) getPublishedMd5Sum() (string, error) {
 	return strings.TrimSpace(string(body)), nil
 }
 
-func (d *Downloader) getPublishedTarball() (io.ReadCloser, error) {
-	log.Debugf("Downloading Amazon EC2 Container Service Agent from %s", config.AgentRemoteTarball())
-	resp, err := d.getter.Get(config.AgentRemoteTarball())
+// LoadCachedAgent returns an io.ReadCloser of the Agent from the cache,
+// resolving the "current" ref to its blob. If no refs have been recorded
+// yet (a cache populated before the content-addressable layout existed),
+// it falls back to the fixed-path tarball. The blob's cached signature, if
+// any, is re-verified so that tampering with the on-disk cache between
+// reboots is caught before the Agent is loaded.
+func (d *Downloader) LoadCachedAgent() (io.ReadCloser, error) {
+	digest, err := readRef(d.fs, refCurrent)
 	if err != nil {
-		return nil, err
+		return d.fs.Open(config.AgentTarball())
 	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected response code %d", resp.StatusCode)
+	if err := d.verifyPersistedSignature(digest); err != nil {
+		return nil, err
 	}
-	return resp.Body, nil
+	return openRef(d.fs, refCurrent)
 }
 
-// LoadCachedAgent returns an io.ReadCloser of the Agent from the cache
-func (d *Downloader) LoadCachedAgent() (io.ReadCloser, error) {
-	return d.fs.Open(config.AgentTarball())
+// verifyPersistedSignature re-verifies the signature cached by
+// verifyAndPersistSignature at download time, guarding against a cached
+// blob being tampered with on disk. A missing signature file is treated as
+// unverified rather than fatal, since it predates signature verification
+// support or ECS_SKIP_SIGNATURE_VERIFICATION was set at download time.
+func (d *Downloader) verifyPersistedSignature(digest string) error {
+	if config.SkipSignatureVerification() {
+		return nil
+	}
+	file, err := d.fs.Open(signaturePath(digest))
+	if err != nil {
+		log.Debugf("No cached signature for %s, skipping re-verification: %v", digest, err)
+		return nil
+	}
+	defer file.Close()
+	sig, err := d.fs.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	if err := sigverify.Verify(digest, sig); err != nil {
+		return fmt.Errorf("cached Agent image failed signature re-verification: %v", err)
+	}
+	return nil
 }
 
+// RecordCachedAgent marks the most recently downloaded ("desired") Agent
+// image as the current one, rotating the previous current blob to
+// "previous" so it remains available for rollback.
 func (d *Downloader) RecordCachedAgent() error {
+	if err := d.promoteDesiredToCurrent(); err != nil {
+		log.Debugf("Could not promote desired agent ref to current, falling back to cache state file: %v", err)
+	}
 	data := []byte("1")
 	return d.fs.WriteFile(config.CacheState(), data, orwPerm)
 }
@@ -0,0 +1,214 @@
+// Copyright 2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/aws/amazon-ecs-init/ecs-init/config"
+)
+
+const (
+	// refCurrent is the ref pointing at the Agent image currently loaded
+	// into the Docker daemon.
+	refCurrent = "current"
+	// refDesired is the ref pointing at the Agent image that should be
+	// loaded on the next start, as set by DownloadAgent.
+	refDesired = "desired"
+	// refPrevious is the ref this init process rolled forward from, kept
+	// around so an operator can roll back without re-downloading.
+	refPrevious = "previous"
+)
+
+// ref is a small JSON pointer file mapping a symbolic name (current,
+// desired, previous) to the digest of a blob in blobsDir(), mirroring the
+// OCI image-layout refs directory.
+type ref struct {
+	Digest string `json:"digest"`
+}
+
+// blobsDir returns <cacheDir>/blobs/sha256, the directory blobs are stored
+// in, named by their hex-encoded sha256 digest.
+func blobsDir() string {
+	return filepath.Join(config.CacheDirectory(), "blobs", "sha256")
+}
+
+// blobPath returns the on-disk path for the blob with the given "sha256:"
+// prefixed digest.
+func blobPath(digest string) (string, error) {
+	hex, err := digestHex(digest)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(blobsDir(), hex), nil
+}
+
+// refsDir returns <cacheDir>/refs, the directory of name->digest pointer
+// files.
+func refsDir() string {
+	return filepath.Join(config.CacheDirectory(), "refs")
+}
+
+func refPath(name string) string {
+	return filepath.Join(refsDir(), name)
+}
+
+// signaturesDir returns <cacheDir>/signatures, where detached signatures are
+// cached next to the blob they cover so they can be re-verified on load.
+func signaturesDir() string {
+	return filepath.Join(config.CacheDirectory(), "signatures")
+}
+
+// signaturePath returns the on-disk path of the cached signature for the
+// blob with the given "sha256:" prefixed digest.
+func signaturePath(digest string) string {
+	hex, err := digestHex(digest)
+	if err != nil {
+		return filepath.Join(signaturesDir(), digest)
+	}
+	return filepath.Join(signaturesDir(), hex+".sig")
+}
+
+func digestHex(digest string) (string, error) {
+	const prefix = "sha256:"
+	if len(digest) <= len(prefix) || digest[:len(prefix)] != prefix {
+		return "", fmt.Errorf("unsupported digest algorithm in %q", digest)
+	}
+	return digest[len(prefix):], nil
+}
+
+// writeBlob moves tempFile (already verified) into the content-addressable
+// blob store under its digest, creating the blobs directory if needed.
+func writeBlob(fs fileSystem, tempFilePath, digest string) error {
+	if err := fs.MkdirAll(blobsDir(), os.ModeDir|orwPerm); err != nil {
+		return err
+	}
+	dest, err := blobPath(digest)
+	if err != nil {
+		return err
+	}
+	return fs.Rename(tempFilePath, dest)
+}
+
+// writeRef records that the symbolic name now points at digest.
+func writeRef(fs fileSystem, name, digest string) error {
+	if err := fs.MkdirAll(refsDir(), os.ModeDir|orwPerm); err != nil {
+		return err
+	}
+	data, err := json.Marshal(ref{Digest: digest})
+	if err != nil {
+		return err
+	}
+	return fs.WriteFile(refPath(name), data, orwPerm)
+}
+
+// readRef resolves a symbolic name to the digest it currently points at.
+func readRef(fs fileSystem, name string) (string, error) {
+	file, err := fs.Open(refPath(name))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	body, err := fs.ReadAll(file)
+	if err != nil {
+		return "", err
+	}
+	var r ref
+	if err := json.Unmarshal(body, &r); err != nil {
+		return "", fmt.Errorf("parsing ref %q: %v", name, err)
+	}
+	return r.Digest, nil
+}
+
+// openRef resolves name to a digest and opens the corresponding blob.
+func openRef(fs fileSystem, name string) (io.ReadCloser, error) {
+	digest, err := readRef(fs, name)
+	if err != nil {
+		return nil, err
+	}
+	path, err := blobPath(digest)
+	if err != nil {
+		return nil, err
+	}
+	return fs.Open(path)
+}
+
+// promoteDesiredToCurrent rotates the current ref to previous (if any) and
+// promotes desired to current. It is called once the desired Agent image
+// has been successfully loaded and started.
+func (d *Downloader) promoteDesiredToCurrent() error {
+	desiredDigest, err := readRef(d.fs, refDesired)
+	if err != nil {
+		return err
+	}
+	if currentDigest, err := readRef(d.fs, refCurrent); err == nil {
+		if err := writeRef(d.fs, refPrevious, currentDigest); err != nil {
+			return err
+		}
+	}
+	return writeRef(d.fs, refCurrent, desiredDigest)
+}
+
+// referencedBlobHexes returns the hex digest of every blob still reachable
+// from the current, desired, or previous ref.
+func referencedBlobHexes(fs fileSystem) map[string]bool {
+	referenced := make(map[string]bool)
+	for _, name := range []string{refCurrent, refDesired, refPrevious} {
+		digest, err := readRef(fs, name)
+		if err != nil {
+			continue
+		}
+		hex, err := digestHex(digest)
+		if err != nil {
+			continue
+		}
+		referenced[hex] = true
+	}
+	return referenced
+}
+
+// isReferencedBlob reports whether the blob named hex (as it appears in
+// blobsDir()) is still reachable from the current, desired, or previous
+// ref. It is used to pin in-use blobs against filecache's age/size-based
+// eviction, independently of GarbageCollect's own unreferenced-blob sweep.
+func isReferencedBlob(fs fileSystem, hex string) bool {
+	return referencedBlobHexes(fs)[hex]
+}
+
+// GarbageCollect removes every blob in the content-addressable store that
+// is not reachable from current, desired, or previous.
+func (d *Downloader) GarbageCollect() error {
+	referenced := referencedBlobHexes(d.fs)
+
+	entries, err := d.fs.ReadDir(blobsDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		if referenced[entry.Name()] {
+			continue
+		}
+		if err := d.fs.Remove(filepath.Join(blobsDir(), entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+// Copyright 2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cache
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeFS is an in-memory fileSystem, keyed by path, so tests can exercise
+// the CAS ref/blob logic without touching the real filesystem or needing
+// config.CacheDirectory() to point anywhere writable.
+type fakeFS struct {
+	files map[string][]byte
+}
+
+func newFakeFS() *fakeFS {
+	return &fakeFS{files: make(map[string][]byte)}
+}
+
+func (f *fakeFS) Open(name string) (io.ReadCloser, error) {
+	data, ok := f.files[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (f *fakeFS) ReadAll(r io.Reader) ([]byte, error) {
+	return io.ReadAll(r)
+}
+
+func (f *fakeFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	f.files[name] = append([]byte(nil), data...)
+	return nil
+}
+
+func (f *fakeFS) MkdirAll(path string, perm os.FileMode) error {
+	return nil
+}
+
+func (f *fakeFS) Remove(name string) error {
+	delete(f.files, name)
+	return nil
+}
+
+func (f *fakeFS) Rename(oldpath, newpath string) error {
+	data, ok := f.files[oldpath]
+	if !ok {
+		return os.ErrNotExist
+	}
+	f.files[newpath] = data
+	delete(f.files, oldpath)
+	return nil
+}
+
+func (f *fakeFS) Stat(name string) (os.FileInfo, error) {
+	return nil, os.ErrNotExist
+}
+
+func (f *fakeFS) TempFile(dir, pattern string) (*os.File, error) {
+	return os.CreateTemp(dir, pattern)
+}
+
+func (f *fakeFS) Copy(dst io.Writer, src io.Reader) (int64, error) {
+	return io.Copy(dst, src)
+}
+
+func (f *fakeFS) TeeReader(r io.Reader, w io.Writer) io.Reader {
+	return io.TeeReader(r, w)
+}
+
+func (f *fakeFS) Base(path string) string {
+	return filepath.Base(path)
+}
+
+// ReadDir lists the direct children of dir among fakeFS's flat, in-memory
+// path->contents map, mimicking os.ReadDir closely enough for
+// GarbageCollect's blobsDir() listing.
+func (f *fakeFS) ReadDir(dir string) ([]os.DirEntry, error) {
+	prefix := dir
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	seen := make(map[string]bool)
+	var entries []os.DirEntry
+	for path := range f.files {
+		if !strings.HasPrefix(path, prefix) {
+			continue
+		}
+		name := strings.TrimPrefix(path, prefix)
+		if strings.Contains(name, "/") || seen[name] {
+			continue
+		}
+		seen[name] = true
+		entries = append(entries, fakeDirEntry(name))
+	}
+	return entries, nil
+}
+
+// fakeDirEntry is a minimal os.DirEntry for a flat, non-directory fakeFS
+// entry.
+type fakeDirEntry string
+
+func (e fakeDirEntry) Name() string               { return string(e) }
+func (e fakeDirEntry) IsDir() bool                { return false }
+func (e fakeDirEntry) Type() os.FileMode          { return 0 }
+func (e fakeDirEntry) Info() (os.FileInfo, error) { return nil, nil }
+
+const (
+	testDigestA = "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	testDigestB = "sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	testDigestC = "sha256:cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc"
+)
+
+func TestWriteReadRef(t *testing.T) {
+	fs := newFakeFS()
+	if err := writeRef(fs, refDesired, testDigestA); err != nil {
+		t.Fatalf("writeRef: %v", err)
+	}
+	got, err := readRef(fs, refDesired)
+	if err != nil {
+		t.Fatalf("readRef: %v", err)
+	}
+	if got != testDigestA {
+		t.Errorf("readRef returned %q, want %q", got, testDigestA)
+	}
+
+	if _, err := readRef(fs, refCurrent); err == nil {
+		t.Error("expected readRef to fail for a ref that was never written")
+	}
+}
+
+func TestPromoteDesiredToCurrent(t *testing.T) {
+	fs := newFakeFS()
+
+	// No prior current: promoting just sets current, no previous is written.
+	if err := writeRef(fs, refDesired, testDigestA); err != nil {
+		t.Fatalf("writeRef(desired): %v", err)
+	}
+	if err := (&Downloader{fs: fs}).promoteDesiredToCurrent(); err != nil {
+		t.Fatalf("promoteDesiredToCurrent: %v", err)
+	}
+	if got, err := readRef(fs, refCurrent); err != nil || got != testDigestA {
+		t.Fatalf("current = %q, %v; want %q, nil", got, err, testDigestA)
+	}
+	if _, err := readRef(fs, refPrevious); err == nil {
+		t.Error("expected no previous ref after the first promotion")
+	}
+
+	// A second promotion rotates the old current into previous.
+	if err := writeRef(fs, refDesired, testDigestB); err != nil {
+		t.Fatalf("writeRef(desired): %v", err)
+	}
+	if err := (&Downloader{fs: fs}).promoteDesiredToCurrent(); err != nil {
+		t.Fatalf("promoteDesiredToCurrent: %v", err)
+	}
+	if got, err := readRef(fs, refCurrent); err != nil || got != testDigestB {
+		t.Fatalf("current = %q, %v; want %q, nil", got, err, testDigestB)
+	}
+	if got, err := readRef(fs, refPrevious); err != nil || got != testDigestA {
+		t.Fatalf("previous = %q, %v; want %q, nil", got, err, testDigestA)
+	}
+}
+
+func TestIsReferencedBlob(t *testing.T) {
+	fs := newFakeFS()
+	if err := writeRef(fs, refCurrent, testDigestA); err != nil {
+		t.Fatalf("writeRef(current): %v", err)
+	}
+	if err := writeRef(fs, refDesired, testDigestB); err != nil {
+		t.Fatalf("writeRef(desired): %v", err)
+	}
+
+	hexA, _ := digestHex(testDigestA)
+	hexB, _ := digestHex(testDigestB)
+	hexC, _ := digestHex(testDigestC)
+
+	if !isReferencedBlob(fs, hexA) {
+		t.Errorf("expected %s (current) to be referenced", hexA)
+	}
+	if !isReferencedBlob(fs, hexB) {
+		t.Errorf("expected %s (desired) to be referenced", hexB)
+	}
+	if isReferencedBlob(fs, hexC) {
+		t.Errorf("expected %s (no ref) to be unreferenced", hexC)
+	}
+}
+
+func TestGarbageCollect(t *testing.T) {
+	fs := newFakeFS()
+	if err := writeRef(fs, refCurrent, testDigestA); err != nil {
+		t.Fatalf("writeRef(current): %v", err)
+	}
+
+	hexA, _ := digestHex(testDigestA)
+	hexB, _ := digestHex(testDigestB)
+	referencedPath := filepath.Join(blobsDir(), hexA)
+	unreferencedPath := filepath.Join(blobsDir(), hexB)
+	if err := fs.WriteFile(referencedPath, []byte("referenced"), 0600); err != nil {
+		t.Fatalf("writing referenced blob: %v", err)
+	}
+	if err := fs.WriteFile(unreferencedPath, []byte("unreferenced"), 0600); err != nil {
+		t.Fatalf("writing unreferenced blob: %v", err)
+	}
+
+	d := &Downloader{fs: fs}
+	if err := d.GarbageCollect(); err != nil {
+		t.Fatalf("GarbageCollect: %v", err)
+	}
+
+	if _, ok := fs.files[referencedPath]; !ok {
+		t.Error("GarbageCollect removed a blob still referenced by current")
+	}
+	if _, ok := fs.files[unreferencedPath]; ok {
+		t.Error("GarbageCollect did not remove an unreferenced blob")
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright 2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package filecache provides a small collection of named, size- and
+// age-bounded on-disk caches, consolidating the various directories
+// ecs-init accumulates files in (the Agent tarball, desired-image
+// artifacts, GPG keyrings, detached signatures) behind one pruning policy.
+package filecache
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const lockSuffix = ".lock"
+
+// staleLockTimeout is how long a lock file may sit unmodified before Lock
+// assumes the process that created it (e.g. a download interrupted by a
+// crash or an instance reboot) is gone and steals it, rather than blocking
+// forever on a lock nothing will ever release.
+const staleLockTimeout = 10 * time.Minute
+
+// Cache is a single named, directory-backed cache with an optional maximum
+// entry age and total size. A zero MaxAge or MaxSizeBytes means unbounded.
+type Cache struct {
+	Name         string
+	Dir          string
+	MaxAge       time.Duration
+	MaxSizeBytes int64
+	// Pinned, if set, is consulted before Prune deletes an entry (by
+	// os.DirEntry.Name()) for age or size. It returns true for entries that
+	// must survive pruning regardless of age or size pressure — e.g. the
+	// blobs backing the content-addressable refs a cache's owner still
+	// points at.
+	Pinned func(name string) bool
+}
+
+func (c *Cache) pinned(name string) bool {
+	return c.Pinned != nil && c.Pinned(name)
+}
+
+// Manager owns a fixed set of named caches, typically "agent", "desired",
+// "gpg", and "signatures".
+type Manager struct {
+	caches map[string]*Cache
+}
+
+// NewManager returns a Manager owning the given caches, indexed by name.
+func NewManager(caches ...*Cache) *Manager {
+	m := &Manager{caches: make(map[string]*Cache, len(caches))}
+	for _, c := range caches {
+		m.caches[c.Name] = c
+	}
+	return m
+}
+
+// Cache returns the named cache, or nil if no cache with that name was
+// registered.
+func (m *Manager) Cache(name string) *Cache {
+	return m.caches[name]
+}
+
+// Prune runs Cache.Prune on every registered cache, stopping early if ctx
+// is done.
+func (m *Manager) Prune(ctx context.Context) error {
+	for _, c := range m.caches {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := c.Prune(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Prune deletes entries older than MaxAge, then deletes the
+// least-recently-modified remaining entries until the cache is back under
+// MaxSizeBytes. An entry currently held by a Lock is never deleted.
+func (c *Cache) Prune(ctx context.Context) error {
+	entries, err := os.ReadDir(c.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	type fileInfo struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var files []fileInfo
+	now := time.Now()
+
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) == lockSuffix {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if c.pinned(entry.Name()) {
+			continue
+		}
+
+		path := filepath.Join(c.Dir, entry.Name())
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		if c.MaxAge > 0 && now.Sub(info.ModTime()) > c.MaxAge {
+			c.removeIfUnlocked(path)
+			continue
+		}
+		files = append(files, fileInfo{path: path, size: info.Size(), modTime: info.ModTime()})
+	}
+
+	if c.MaxSizeBytes <= 0 {
+		return nil
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+	for _, f := range files {
+		if total <= c.MaxSizeBytes {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if c.removeIfUnlocked(f.path) {
+			total -= f.size
+		}
+	}
+	return nil
+}
+
+// removeIfUnlocked deletes path unless a concurrent download holds its
+// lock file, returning whether the file was removed.
+func (c *Cache) removeIfUnlocked(path string) bool {
+	lock, err := tryLock(path)
+	if err != nil {
+		return false
+	}
+	defer lock.unlock()
+	return os.Remove(path) == nil
+}
+
+// fileLock is a cooperative, advisory lock implemented as a sibling
+// "<path>.lock" file, held for the duration of a download or a prune pass
+// so the two never race on the same cache entry.
+type fileLock struct {
+	path string
+}
+
+// Lock creates (or waits to create) the lock file for path, blocking other
+// callers of Lock or tryLock on the same path until Unlock is called.
+// Callers downloading into a cache entry should hold the lock for the
+// duration of the write. A lock file older than staleLockTimeout is assumed
+// abandoned by a process that crashed or was killed mid-download and is
+// stolen rather than waited on forever.
+func Lock(path string) (*fileLock, error) {
+	lockPath := path + lockSuffix
+	for {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			f.Close()
+			return &fileLock{path: lockPath}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if info, statErr := os.Stat(lockPath); statErr == nil && time.Since(info.ModTime()) > staleLockTimeout {
+			os.Remove(lockPath)
+			continue
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// tryLock is the non-blocking variant of Lock, used by Prune so it never
+// waits on a download in progress.
+func tryLock(path string) (*fileLock, error) {
+	lockPath := path + lockSuffix
+	f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	return &fileLock{path: lockPath}, nil
+}
+
+func (l *fileLock) unlock() error {
+	return os.Remove(l.path)
+}
+
+// Unlock releases a lock acquired with Lock.
+func (l *fileLock) Unlock() error {
+	return l.unlock()
+}
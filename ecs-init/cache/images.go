@@ -0,0 +1,344 @@
+// Copyright 2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cache
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// inMemoryEntryThreshold is the largest tar entry indexTarball will buffer
+// in memory; anything bigger (in practice, a layer.tar) is spilled to a
+// temp file instead, so bundling sidecar images alongside the Agent doesn't
+// multiply ecs-init's memory footprint by however many images are packed
+// into the tarball.
+const inMemoryEntryThreshold = 1 << 20 // 1 MiB
+
+// LoadedImage is a single image extracted from a multi-image docker-archive
+// tarball (as produced by `docker save img1 img2` or Podman's multi-image
+// archives), ready to be fed to the Docker daemon on its own.
+type LoadedImage struct {
+	RepoTags     []string
+	ConfigDigest string
+	Reader       io.ReadCloser
+}
+
+// LoadCachedImages returns every image packaged in the cached Agent
+// tarball. A tarball whose manifest.json lists multiple entries (the
+// Agent bundled alongside sidecar images such as pause, a pull-through
+// cache, or telemetry) yields one LoadedImage per entry. Each entry's config
+// and layers must be present in the tarball, and a config whose filename is
+// a sha256 digest is checked against it; layer contents are not hashed (see
+// validateManifestEntry). A single-entry
+// manifest.json, or a legacy tarball with no manifest.json at all, yields
+// exactly one LoadedImage equivalent to what LoadCachedAgent returns today.
+func (d *Downloader) LoadCachedImages() ([]LoadedImage, error) {
+	tarball, err := d.LoadCachedAgent()
+	if err != nil {
+		return nil, err
+	}
+	defer tarball.Close()
+
+	entries, err := indexTarball(tarball)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, e := range entries {
+			e.cleanup()
+		}
+	}()
+
+	manifestEntry, ok := entries["manifest.json"]
+	if !ok {
+		return []LoadedImage{{Reader: singleUseTarball(entries)}}, nil
+	}
+
+	manifestBytes, err := manifestEntry.readAll()
+	if err != nil {
+		return nil, fmt.Errorf("reading manifest.json: %v", err)
+	}
+	var manifest []dockerLoadManifestEntry
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return nil, fmt.Errorf("parsing manifest.json: %v", err)
+	}
+
+	images := make([]LoadedImage, 0, len(manifest))
+	for _, entry := range manifest {
+		if err := validateManifestEntry(entries, entry); err != nil {
+			return nil, fmt.Errorf("validating image %v: %v", entry.RepoTags, err)
+		}
+
+		single := map[string]*tarEntry{
+			entry.Config: entries[entry.Config],
+			"manifest.json": newInMemoryEntry(mustMarshal([]dockerLoadManifestEntry{{
+				Config:   entry.Config,
+				RepoTags: entry.RepoTags,
+				Layers:   entry.Layers,
+			}})),
+		}
+		for _, layer := range entry.Layers {
+			single[layer] = entries[layer]
+		}
+
+		images = append(images, LoadedImage{
+			RepoTags:     entry.RepoTags,
+			ConfigDigest: "sha256:" + trimJSONSuffix(entry.Config),
+			Reader:       singleUseTarball(single),
+		})
+	}
+	return images, nil
+}
+
+// tarEntry is a single regular-file entry extracted from a tar stream by
+// indexTarball, held either in memory (small entries, e.g. manifest.json or
+// an image config) or spilled to a temp file on disk (large entries, e.g. a
+// layer.tar) so indexing a multi-image tarball doesn't hold every layer of
+// every bundled image in memory at once.
+type tarEntry struct {
+	data     []byte
+	tempPath string
+}
+
+func newInMemoryEntry(data []byte) *tarEntry {
+	return &tarEntry{data: data}
+}
+
+// reader opens the entry for reading along with its size. The caller must
+// close the returned reader.
+func (e *tarEntry) reader() (io.ReadCloser, int64, error) {
+	if e.tempPath == "" {
+		return io.NopCloser(bytes.NewReader(e.data)), int64(len(e.data)), nil
+	}
+	f, err := os.Open(e.tempPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+func (e *tarEntry) readAll() ([]byte, error) {
+	if e.tempPath == "" {
+		return e.data, nil
+	}
+	r, _, err := e.reader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// cleanup removes the entry's backing temp file, if it spilled to one. It
+// is a no-op for in-memory entries.
+func (e *tarEntry) cleanup() {
+	if e.tempPath != "" {
+		os.Remove(e.tempPath)
+	}
+}
+
+// indexTarball reads every regular-file entry of a tar stream, keyed by
+// name, so manifest.json's references can be resolved and re-packaged
+// without re-reading the source. Entries at or under
+// inMemoryEntryThreshold are buffered in memory; larger ones are spilled to
+// a temp file. Callers must call cleanup() on every returned entry once
+// done with it.
+func indexTarball(r io.Reader) (map[string]*tarEntry, error) {
+	entries := make(map[string]*tarEntry)
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		entry, err := spillTarEntry(tr, header.Size)
+		if err != nil {
+			return nil, err
+		}
+		entries[header.Name] = entry
+	}
+}
+
+func spillTarEntry(r io.Reader, size int64) (*tarEntry, error) {
+	if size <= inMemoryEntryThreshold {
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return newInMemoryEntry(data), nil
+	}
+
+	f, err := os.CreateTemp("", "ecs-agent-image-entry")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := io.CopyN(f, r, size); err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &tarEntry{tempPath: f.Name()}, nil
+}
+
+// validateManifestEntry verifies the config file and every layer
+// referenced by entry are present, and, where the config's own filename
+// embeds a sha256 digest (Docker always names it after the content digest
+// of the config blob, in both ecs-init's own registry pull and a genuine
+// `docker save`), that its content matches it.
+//
+// The same check is deliberately not applied to Layers: ecs-init's own
+// registry pull names each layer's directory after the sha256 digest of its
+// tar content, but a genuine `docker save` archive names it after the
+// layer's legacy chain ID instead, which happens to also look like a sha256
+// digest but will not equal the tar's content hash. Treating that as a
+// mismatch would reject every legitimately bundled sidecar image.
+func validateManifestEntry(entries map[string]*tarEntry, entry dockerLoadManifestEntry) error {
+	configEntry, ok := entries[entry.Config]
+	if !ok {
+		return fmt.Errorf("missing config %s", entry.Config)
+	}
+	if digest := trimJSONSuffix(entry.Config); looksLikeDigest(digest) {
+		configData, err := configEntry.readAll()
+		if err != nil {
+			return fmt.Errorf("config %s: %v", entry.Config, err)
+		}
+		if err := verifySha256(configData, digest); err != nil {
+			return fmt.Errorf("config %s: %v", entry.Config, err)
+		}
+	}
+
+	for _, layer := range entry.Layers {
+		if _, ok := entries[layer]; !ok {
+			return fmt.Errorf("missing layer %s", layer)
+		}
+	}
+	return nil
+}
+
+func verifySha256(data []byte, expectedHex string) error {
+	sum := fmt.Sprintf("%x", sha256.Sum256(data))
+	if sum != expectedHex {
+		return fmt.Errorf("mismatched sha256, expected %s got %s", expectedHex, sum)
+	}
+	return nil
+}
+
+func trimJSONSuffix(name string) string {
+	const suffix = ".json"
+	if len(name) > len(suffix) && name[len(name)-len(suffix):] == suffix {
+		return name[:len(name)-len(suffix)]
+	}
+	return name
+}
+
+func looksLikeDigest(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func mustMarshal(v interface{}) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// singleUseTarball re-packages the named entries as a fresh tar stream, in
+// the form `docker load` expects, writing it to a temp file rather than
+// holding the whole thing in memory. The returned ReadCloser deletes that
+// temp file when closed.
+func singleUseTarball(entries map[string]*tarEntry) io.ReadCloser {
+	f, err := os.CreateTemp("", "ecs-agent-image")
+	if err != nil {
+		return errorReadCloser{err}
+	}
+
+	if err := writeTarball(f, entries); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return errorReadCloser{err}
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return errorReadCloser{err}
+	}
+	return selfDeletingFile{f}
+}
+
+func writeTarball(w io.Writer, entries map[string]*tarEntry) error {
+	tw := tar.NewWriter(w)
+	for name, entry := range entries {
+		r, size, err := entry.reader()
+		if err != nil {
+			return err
+		}
+		writeErr := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: size})
+		if writeErr == nil {
+			_, writeErr = io.Copy(tw, r)
+		}
+		r.Close()
+		if writeErr != nil {
+			return writeErr
+		}
+	}
+	return tw.Close()
+}
+
+// selfDeletingFile deletes its backing temp file as part of Close, so a
+// LoadedImage.Reader doesn't leak the tarball it was re-packaged into.
+type selfDeletingFile struct {
+	*os.File
+}
+
+func (f selfDeletingFile) Close() error {
+	closeErr := f.File.Close()
+	if err := os.Remove(f.File.Name()); err != nil && closeErr == nil {
+		return err
+	}
+	return closeErr
+}
+
+// errorReadCloser reports err from Read without ever touching disk, for the
+// rare case singleUseTarball itself fails to set up its temp file.
+type errorReadCloser struct {
+	err error
+}
+
+func (e errorReadCloser) Read([]byte) (int, error) { return 0, e.err }
+func (e errorReadCloser) Close() error             { return nil }
@@ -0,0 +1,148 @@
+// Copyright 2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cache
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+)
+
+func buildTarball(t *testing.T, files map[string][]byte) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, data := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data))}); err != nil {
+			t.Fatalf("writing header for %s: %v", name, err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatalf("writing data for %s: %v", name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("closing tar writer: %v", err)
+	}
+	return &buf
+}
+
+// TestValidateManifestEntry_RealDockerSaveLayerIDs mirrors a genuine `docker
+// save` archive, where the Layers directory name is a legacy chain ID
+// rather than the sha256 of the layer.tar bytes it contains. Validation
+// must not reject that as a digest mismatch.
+func TestValidateManifestEntry_RealDockerSaveLayerIDs(t *testing.T) {
+	const configJSON = `{"config":{}}`
+	configDigest := fmt.Sprintf("%x", sha256.Sum256([]byte(configJSON)))
+	legacyLayerID := "cafebabecafebabecafebabecafebabecafebabecafebabecafebabecafebabe"[:64]
+
+	entries := map[string]*tarEntry{
+		configDigest + ".json":       newInMemoryEntry([]byte(configJSON)),
+		legacyLayerID + "/layer.tar": newInMemoryEntry([]byte("totally different content than the legacy id implies")),
+	}
+
+	entry := dockerLoadManifestEntry{
+		Config:   configDigest + ".json",
+		RepoTags: []string{"pause:3.5"},
+		Layers:   []string{legacyLayerID + "/layer.tar"},
+	}
+
+	if err := validateManifestEntry(entries, entry); err != nil {
+		t.Errorf("validateManifestEntry rejected a genuine docker save layout: %v", err)
+	}
+}
+
+func TestValidateManifestEntry_MissingLayer(t *testing.T) {
+	entries := map[string]*tarEntry{
+		"config.json": newInMemoryEntry([]byte("{}")),
+	}
+	entry := dockerLoadManifestEntry{
+		Config: "config.json",
+		Layers: []string{"missing/layer.tar"},
+	}
+	if err := validateManifestEntry(entries, entry); err == nil {
+		t.Error("expected an error for a layer absent from the tarball")
+	}
+}
+
+func TestIndexTarball_SpillsLargeEntries(t *testing.T) {
+	small := []byte("manifest contents")
+	large := bytes.Repeat([]byte("x"), inMemoryEntryThreshold+1)
+
+	tarball := buildTarball(t, map[string][]byte{
+		"manifest.json":      small,
+		"deadbeef/layer.tar": large,
+	})
+
+	entries, err := indexTarball(tarball)
+	if err != nil {
+		t.Fatalf("indexTarball: %v", err)
+	}
+	defer func() {
+		for _, e := range entries {
+			e.cleanup()
+		}
+	}()
+
+	manifestEntry := entries["manifest.json"]
+	if manifestEntry.tempPath != "" {
+		t.Error("expected the small manifest.json entry to stay in memory")
+	}
+	got, err := manifestEntry.readAll()
+	if err != nil || !bytes.Equal(got, small) {
+		t.Errorf("manifest.json readAll() = %q, %v; want %q, nil", got, err, small)
+	}
+
+	layerEntry := entries["deadbeef/layer.tar"]
+	if layerEntry.tempPath == "" {
+		t.Error("expected the oversized layer entry to spill to a temp file")
+	}
+	got, err = layerEntry.readAll()
+	if err != nil || !bytes.Equal(got, large) {
+		t.Error("layer.tar readAll() did not round-trip the spilled content")
+	}
+}
+
+func TestSingleUseTarball_RoundTripsAndDeletesOnClose(t *testing.T) {
+	entries := map[string]*tarEntry{
+		"manifest.json": newInMemoryEntry([]byte("hello")),
+	}
+
+	rc := singleUseTarball(entries)
+	backing, ok := rc.(selfDeletingFile)
+	if !ok {
+		t.Fatalf("singleUseTarball returned %T, want a selfDeletingFile", rc)
+	}
+	tr := tar.NewReader(rc)
+	header, err := tr.Next()
+	if err != nil {
+		t.Fatalf("reading re-packaged tar entry: %v", err)
+	}
+	if header.Name != "manifest.json" {
+		t.Errorf("entry name = %q, want manifest.json", header.Name)
+	}
+	data, err := io.ReadAll(tr)
+	if err != nil || string(data) != "hello" {
+		t.Errorf("entry contents = %q, %v; want \"hello\", nil", data, err)
+	}
+	if err := rc.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	if _, err := os.Stat(backing.Name()); !os.IsNotExist(err) {
+		t.Errorf("backing temp file %s still present after Close (stat err: %v)", backing.Name(), err)
+	}
+}
@@ -0,0 +1,450 @@
+// Copyright 2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cache
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/aws/amazon-ecs-init/ecs-init/cache/filecache"
+	"github.com/aws/amazon-ecs-init/ecs-init/config"
+	log "github.com/cihub/seelog"
+)
+
+const (
+	manifestV2MediaType = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+// manifestV2Schema2 is the Image Manifest V2, Schema 2 document returned by
+// the registry for a given name/tag.
+// See https://docs.docker.com/registry/spec/manifest-v2-2/
+type manifestV2Schema2 struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Config        descriptor   `json:"config"`
+	Layers        []descriptor `json:"layers"`
+}
+
+// descriptor identifies a blob stored in the registry by content digest.
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Size      int64  `json:"size"`
+	Digest    string `json:"digest"`
+}
+
+// registryAuth holds the bearer token (or basic auth) challenge parameters
+// parsed out of a WWW-Authenticate response header.
+type registryAuth struct {
+	realm   string
+	service string
+	scope   string
+	basic   bool
+}
+
+// RegistryDownloader pulls the Agent image directly from an OCI/Docker
+// Distribution V2 registry (ECR, Docker Hub, or a private mirror) using the
+// Registry HTTP API V2 and Image Manifest V2, Schema 2. It is preferred over
+// the flat tarball download when config.AgentRegistryEndpoint() is set.
+type RegistryDownloader struct {
+	getter httpGetter
+	fs     fileSystem
+}
+
+// NewRegistryDownloader returns a RegistryDownloader with default dependencies
+func NewRegistryDownloader() *RegistryDownloader {
+	return &RegistryDownloader{
+		getter: customGetter,
+		fs:     &standardFS{},
+	}
+}
+
+// Pull fetches the manifest and every referenced layer for
+// config.AgentRegistryRepository():config.AgentRegistryTag(), assembles a
+// docker-load compatible tarball, and writes it to config.AgentTarball().
+func (r *RegistryDownloader) Pull() error {
+	endpoint := config.AgentRegistryEndpoint()
+	repository := config.AgentRegistryRepository()
+	tag := config.AgentRegistryTag()
+
+	token, err := r.authenticate(endpoint, repository)
+	if err != nil {
+		return fmt.Errorf("registry: authenticating to %s: %v", endpoint, err)
+	}
+
+	manifest, err := r.fetchManifest(endpoint, repository, tag, token)
+	if err != nil {
+		return fmt.Errorf("registry: fetching manifest for %s:%s: %v", repository, tag, err)
+	}
+
+	tempFile, err := r.fs.TempFile("", "ecs-agent-registry.tar")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			log.Debugf("Removing temp file %s", tempFile.Name())
+			r.fs.Remove(tempFile.Name())
+		}
+	}()
+	defer tempFile.Close()
+
+	if err = r.assembleTarball(tempFile, endpoint, repository, token, manifest); err != nil {
+		return err
+	}
+	if _, err = tempFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	digest, err := sha256OfFile(r.fs, tempFile)
+	if err != nil {
+		return err
+	}
+	if err = verifyAndPersistSignature(r.getter, r.fs, digest); err != nil {
+		return err
+	}
+
+	blobDest, err := blobPath(digest)
+	if err != nil {
+		return err
+	}
+	if err = r.fs.MkdirAll(blobsDir(), os.ModeDir|orwPerm); err != nil {
+		return err
+	}
+	// Held for the blob's write-then-rename so a concurrent Prune pass can
+	// never race the rename and remove a partially-written blob.
+	lock, err := filecache.Lock(blobDest)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	if err = writeBlob(r.fs, tempFile.Name(), digest); err != nil {
+		return err
+	}
+	if err = writeRef(r.fs, refDesired, digest); err != nil {
+		return err
+	}
+
+	path, err := blobPath(digest)
+	if err != nil {
+		return err
+	}
+	src, err := r.fs.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	compat, err := r.fs.TempFile("", "ecs-agent-compat.tar")
+	if err != nil {
+		return err
+	}
+	defer compat.Close()
+	if _, err = r.fs.Copy(compat, src); err != nil {
+		r.fs.Remove(compat.Name())
+		return err
+	}
+	log.Debugf("Attempting to rename %s to %s", compat.Name(), config.AgentTarball())
+	return r.fs.Rename(compat.Name(), config.AgentTarball())
+}
+
+// sha256OfFile hashes f (already positioned at the start) for use as its
+// content-addressable digest.
+func sha256OfFile(fs fileSystem, f io.Reader) (string, error) {
+	hash := sha256.New()
+	if _, err := fs.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sha256:%x", hash.Sum(nil)), nil
+}
+
+// fetchManifest performs GET /v2/<name>/manifests/<tag> and parses the
+// Image Manifest V2, Schema 2 response.
+func (r *RegistryDownloader) fetchManifest(endpoint, repository, tag, token string) (*manifestV2Schema2, error) {
+	manifestURL := fmt.Sprintf("%s/v2/%s/manifests/%s", strings.TrimRight(endpoint, "/"), repository, tag)
+	req, err := http.NewRequest(http.MethodGet, manifestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", manifestV2MediaType)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := r.getter.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response code %d fetching manifest", resp.StatusCode)
+	}
+
+	body, err := r.fs.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var manifest manifestV2Schema2
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return nil, fmt.Errorf("parsing manifest: %v", err)
+	}
+	if manifest.SchemaVersion != 2 || manifest.MediaType != manifestV2MediaType {
+		return nil, fmt.Errorf("unsupported manifest schemaVersion %d mediaType %q, expected a Image Manifest V2, Schema 2",
+			manifest.SchemaVersion, manifest.MediaType)
+	}
+	if len(manifest.Layers) == 0 {
+		return nil, fmt.Errorf("manifest for %s:%s has no layers", repository, tag)
+	}
+	return &manifest, nil
+}
+
+// fetchBlob performs GET /v2/<name>/blobs/<digest>, streaming the response
+// into dst while verifying the running sha256 matches digest before it is
+// accepted.
+func (r *RegistryDownloader) fetchBlob(endpoint, repository, token string, desc descriptor, dst io.Writer) error {
+	blobURL := fmt.Sprintf("%s/v2/%s/blobs/%s", strings.TrimRight(endpoint, "/"), repository, desc.Digest)
+	req, err := http.NewRequest(http.MethodGet, blobURL, nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := r.getter.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response code %d fetching blob %s", resp.StatusCode, desc.Digest)
+	}
+
+	hash := sha256.New()
+	teeReader := r.fs.TeeReader(resp.Body, hash)
+	if _, err := r.fs.Copy(dst, teeReader); err != nil {
+		return err
+	}
+
+	calculated := fmt.Sprintf("sha256:%x", hash.Sum(nil))
+	if calculated != desc.Digest {
+		return fmt.Errorf("mismatched digest for blob, expected %s got %s", desc.Digest, calculated)
+	}
+	return nil
+}
+
+// assembleTarball writes a docker-load compatible tarball (manifest.json,
+// repositories, the image config, and every layer) to w.
+func (r *RegistryDownloader) assembleTarball(w io.WriteSeeker, endpoint, repository, token string, manifest *manifestV2Schema2) error {
+	tw := tar.NewWriter(w)
+	defer tw.Close()
+
+	configName := strings.TrimPrefix(manifest.Config.Digest, "sha256:") + ".json"
+	configBuf, err := r.fetchBlobToBuffer(endpoint, repository, token, manifest.Config)
+	if err != nil {
+		return fmt.Errorf("fetching image config: %v", err)
+	}
+	if err := writeTarEntry(tw, configName, configBuf); err != nil {
+		return err
+	}
+
+	layerPaths := make([]string, 0, len(manifest.Layers))
+	for _, layer := range manifest.Layers {
+		layerDir := strings.TrimPrefix(layer.Digest, "sha256:")
+		layerPath := layerDir + "/layer.tar"
+		layerBuf, err := r.fetchBlobToBuffer(endpoint, repository, token, layer)
+		if err != nil {
+			return fmt.Errorf("fetching layer %s: %v", layer.Digest, err)
+		}
+		if err := writeTarEntry(tw, layerPath, layerBuf); err != nil {
+			return err
+		}
+		layerPaths = append(layerPaths, layerPath)
+	}
+
+	repoTag := fmt.Sprintf("%s:%s", repository, config.AgentRegistryTag())
+	manifestJSON, err := json.Marshal([]dockerLoadManifestEntry{{
+		Config:   configName,
+		RepoTags: []string{repoTag},
+		Layers:   layerPaths,
+	}})
+	if err != nil {
+		return err
+	}
+	if err := writeTarEntry(tw, "manifest.json", manifestJSON); err != nil {
+		return err
+	}
+
+	repositories, err := json.Marshal(map[string]map[string]string{
+		repository: {config.AgentRegistryTag(): strings.TrimPrefix(manifest.Layers[len(manifest.Layers)-1].Digest, "sha256:")},
+	})
+	if err != nil {
+		return err
+	}
+	return writeTarEntry(tw, "repositories", repositories)
+}
+
+// dockerLoadManifestEntry mirrors a single entry of the manifest.json
+// produced (and consumed) by `docker save`/`docker load`.
+type dockerLoadManifestEntry struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+func (r *RegistryDownloader) fetchBlobToBuffer(endpoint, repository, token string, desc descriptor) ([]byte, error) {
+	tempFile, err := r.fs.TempFile("", "ecs-agent-blob")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	if err := r.fetchBlob(endpoint, repository, token, desc, tempFile); err != nil {
+		return nil, err
+	}
+	if _, err := tempFile.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return r.fs.ReadAll(tempFile)
+}
+
+func writeTarEntry(tw *tar.Writer, name string, data []byte) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name: name,
+		Mode: 0644,
+		Size: int64(len(data)),
+	}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// authenticate resolves the bearer token needed to pull from the registry,
+// if any. It issues an anonymous GET to the /v2/ endpoint to discover the
+// WWW-Authenticate challenge, then exchanges it for a token: ECR's Basic
+// challenge is satisfied with the credentials from
+// config.AgentRegistryECRAuth() (the result of ecr:GetAuthorizationToken),
+// while a standard Bearer realm/service/scope challenge is exchanged via a
+// GET to the realm.
+func (r *RegistryDownloader) authenticate(endpoint, repository string) (string, error) {
+	pingURL := fmt.Sprintf("%s/v2/", strings.TrimRight(endpoint, "/"))
+	resp, err := r.getter.Get(pingURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return "", nil
+	}
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	auth, err := parseAuthChallenge(challenge)
+	if err != nil {
+		return "", err
+	}
+
+	if auth.basic {
+		username, password, err := config.AgentRegistryECRAuth()
+		if err != nil {
+			return "", err
+		}
+		// ECR token exchange still goes through the realm advertised in the
+		// Basic challenge, authenticated with the ecr:GetAuthorizationToken
+		// basic credentials instead of an anonymous request.
+		return r.exchangeToken(auth, repository, username, password)
+	}
+	return r.exchangeToken(auth, repository, "", "")
+}
+
+func (r *RegistryDownloader) exchangeToken(auth *registryAuth, repository, username, password string) (string, error) {
+	values := url.Values{}
+	if auth.service != "" {
+		values.Set("service", auth.service)
+	}
+	values.Set("scope", fmt.Sprintf("repository:%s:pull", repository))
+
+	req, err := http.NewRequest(http.MethodGet, auth.realm+"?"+values.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+
+	resp, err := r.getter.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected response code %d from token endpoint", resp.StatusCode)
+	}
+
+	body, err := r.fs.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	var tokenResp struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(body, &tokenResp); err != nil {
+		return "", fmt.Errorf("parsing token response: %v", err)
+	}
+	if tokenResp.Token != "" {
+		return tokenResp.Token, nil
+	}
+	return tokenResp.AccessToken, nil
+}
+
+// parseAuthChallenge parses a WWW-Authenticate header of the form
+// `Bearer realm="...",service="...",scope="..."` or `Basic realm="..."`.
+func parseAuthChallenge(header string) (*registryAuth, error) {
+	if header == "" {
+		return nil, fmt.Errorf("missing WWW-Authenticate header")
+	}
+	scheme := strings.SplitN(header, " ", 2)
+	if len(scheme) != 2 {
+		return nil, fmt.Errorf("malformed WWW-Authenticate header %q", header)
+	}
+
+	auth := &registryAuth{basic: strings.EqualFold(scheme[0], "Basic")}
+	for _, param := range strings.Split(scheme[1], ",") {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := strings.Trim(kv[1], `"`)
+		switch strings.ToLower(kv[0]) {
+		case "realm":
+			auth.realm = value
+		case "service":
+			auth.service = value
+		case "scope":
+			auth.scope = value
+		}
+	}
+	if auth.realm == "" {
+		return nil, fmt.Errorf("WWW-Authenticate header %q missing realm", header)
+	}
+	return auth, nil
+}
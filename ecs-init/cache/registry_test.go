@@ -0,0 +1,407 @@
+// Copyright 2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cache
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// scriptedGetter replays fixed queues of responses to Get and Do separately,
+// so a test can script both the plain GETs (registry ping, signature fetch)
+// and the Do calls (token exchange, manifest, blob fetches) a single Pull
+// makes, in order.
+type scriptedGetter struct {
+	getResponses []*http.Response
+	doResponses  []*http.Response
+	doRequests   []*http.Request
+}
+
+func (g *scriptedGetter) Get(url string) (*http.Response, error) {
+	if len(g.getResponses) == 0 {
+		return nil, fmt.Errorf("scriptedGetter: no more Get responses queued for %s", url)
+	}
+	resp := g.getResponses[0]
+	g.getResponses = g.getResponses[1:]
+	return resp, nil
+}
+
+func (g *scriptedGetter) Do(req *http.Request) (*http.Response, error) {
+	g.doRequests = append(g.doRequests, req)
+	if len(g.doResponses) == 0 {
+		return nil, fmt.Errorf("scriptedGetter: no more Do responses queued for %s", req.URL)
+	}
+	resp := g.doResponses[0]
+	g.doResponses = g.doResponses[1:]
+	return resp, nil
+}
+
+func jsonResponse(t *testing.T, status int, v interface{}) *http.Response {
+	t.Helper()
+	body, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("marshaling response body: %v", err)
+	}
+	return newResponse(status, string(body))
+}
+
+func headerResponse(status int, header, value string) *http.Response {
+	resp := newResponse(status, "")
+	resp.Header = make(http.Header)
+	resp.Header.Set(header, value)
+	return resp
+}
+
+// realFS is a fileSystem that performs genuine filesystem operations, for
+// tests (like Pull's) that need writeBlob's rename-into-place and Pull's
+// compat-tarball copy to actually happen on disk, unlike the
+// in-memory fakeFS used by the rest of this package's tests.
+type realFS struct{}
+
+func (realFS) Open(name string) (io.ReadCloser, error) { return os.Open(name) }
+func (realFS) ReadAll(r io.Reader) ([]byte, error)     { return io.ReadAll(r) }
+func (realFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return os.WriteFile(name, data, perm)
+}
+func (realFS) MkdirAll(path string, perm os.FileMode) error     { return os.MkdirAll(path, perm) }
+func (realFS) Remove(name string) error                         { return os.Remove(name) }
+func (realFS) Rename(oldpath, newpath string) error             { return os.Rename(oldpath, newpath) }
+func (realFS) Stat(name string) (os.FileInfo, error)            { return os.Stat(name) }
+func (realFS) TempFile(dir, pattern string) (*os.File, error)   { return os.CreateTemp(dir, pattern) }
+func (realFS) Copy(dst io.Writer, src io.Reader) (int64, error) { return io.Copy(dst, src) }
+func (realFS) TeeReader(r io.Reader, w io.Writer) io.Reader     { return io.TeeReader(r, w) }
+func (realFS) Base(path string) string                          { return filepath.Base(path) }
+func (realFS) ReadDir(dir string) ([]os.DirEntry, error)        { return os.ReadDir(dir) }
+
+func sha256Digest(data []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+}
+
+func TestFetchManifest_Success(t *testing.T) {
+	manifest := manifestV2Schema2{
+		SchemaVersion: 2,
+		MediaType:     manifestV2MediaType,
+		Config:        descriptor{Digest: "sha256:aaaa", Size: 10},
+		Layers:        []descriptor{{Digest: "sha256:bbbb", Size: 20}},
+	}
+	getter := &scriptedGetter{doResponses: []*http.Response{jsonResponse(t, http.StatusOK, manifest)}}
+	r := &RegistryDownloader{getter: getter, fs: newFakeFS()}
+
+	got, err := r.fetchManifest("https://registry.example.com", "repo", "latest", "tok")
+	if err != nil {
+		t.Fatalf("fetchManifest: %v", err)
+	}
+	if len(got.Layers) != 1 || got.Layers[0].Digest != "sha256:bbbb" {
+		t.Errorf("fetchManifest returned %+v, want the single parsed layer", got)
+	}
+	if auth := getter.doRequests[0].Header.Get("Authorization"); auth != "Bearer tok" {
+		t.Errorf("Authorization header = %q, want Bearer tok", auth)
+	}
+}
+
+func TestFetchManifest_RejectsZeroLayers(t *testing.T) {
+	manifest := manifestV2Schema2{SchemaVersion: 2, MediaType: manifestV2MediaType}
+	getter := &scriptedGetter{doResponses: []*http.Response{jsonResponse(t, http.StatusOK, manifest)}}
+	r := &RegistryDownloader{getter: getter, fs: newFakeFS()}
+
+	if _, err := r.fetchManifest("https://registry.example.com", "repo", "latest", ""); err == nil {
+		t.Fatal("expected an error for a manifest with no layers")
+	}
+}
+
+func TestFetchManifest_RejectsUnexpectedMediaType(t *testing.T) {
+	manifest := manifestV2Schema2{
+		SchemaVersion: 2,
+		MediaType:     "application/vnd.docker.distribution.manifest.list.v2+json",
+		Layers:        []descriptor{{Digest: "sha256:bbbb", Size: 20}},
+	}
+	getter := &scriptedGetter{doResponses: []*http.Response{jsonResponse(t, http.StatusOK, manifest)}}
+	r := &RegistryDownloader{getter: getter, fs: newFakeFS()}
+
+	if _, err := r.fetchManifest("https://registry.example.com", "repo", "latest", ""); err == nil {
+		t.Fatal("expected an error for a manifest list served instead of schema2")
+	}
+}
+
+func TestFetchManifest_UnexpectedStatus(t *testing.T) {
+	getter := &scriptedGetter{doResponses: []*http.Response{newResponse(http.StatusNotFound, "")}}
+	r := &RegistryDownloader{getter: getter, fs: newFakeFS()}
+
+	if _, err := r.fetchManifest("https://registry.example.com", "repo", "latest", ""); err == nil {
+		t.Fatal("expected an error for a 404 response")
+	}
+}
+
+func TestFetchBlob_Success(t *testing.T) {
+	content := []byte("blob contents")
+	desc := descriptor{Digest: sha256Digest(content), Size: int64(len(content))}
+	getter := &scriptedGetter{doResponses: []*http.Response{newResponse(http.StatusOK, string(content))}}
+	r := &RegistryDownloader{getter: getter, fs: newFakeFS()}
+
+	var dst bytes.Buffer
+	if err := r.fetchBlob("https://registry.example.com", "repo", "", desc, &dst); err != nil {
+		t.Fatalf("fetchBlob: %v", err)
+	}
+	if dst.String() != string(content) {
+		t.Errorf("fetchBlob wrote %q, want %q", dst.String(), content)
+	}
+}
+
+func TestFetchBlob_DigestMismatch(t *testing.T) {
+	content := []byte("blob contents")
+	desc := descriptor{Digest: "sha256:" + "0000000000000000000000000000000000000000000000000000000000000", Size: int64(len(content))}
+	getter := &scriptedGetter{doResponses: []*http.Response{newResponse(http.StatusOK, string(content))}}
+	r := &RegistryDownloader{getter: getter, fs: newFakeFS()}
+
+	var dst bytes.Buffer
+	if err := r.fetchBlob("https://registry.example.com", "repo", "", desc, &dst); err == nil {
+		t.Fatal("expected an error when the fetched blob does not hash to the expected digest")
+	}
+}
+
+func TestAssembleTarball(t *testing.T) {
+	configContent := []byte(`{"config":{}}`)
+	layerContent := []byte("layer contents")
+	manifest := &manifestV2Schema2{
+		SchemaVersion: 2,
+		MediaType:     manifestV2MediaType,
+		Config:        descriptor{Digest: sha256Digest(configContent), Size: int64(len(configContent))},
+		Layers:        []descriptor{{Digest: sha256Digest(layerContent), Size: int64(len(layerContent))}},
+	}
+	getter := &scriptedGetter{doResponses: []*http.Response{
+		newResponse(http.StatusOK, string(configContent)),
+		newResponse(http.StatusOK, string(layerContent)),
+	}}
+	r := &RegistryDownloader{getter: getter, fs: newFakeFS()}
+
+	out, err := os.CreateTemp("", "assemble-tarball-test")
+	if err != nil {
+		t.Fatalf("CreateTemp: %v", err)
+	}
+	t.Cleanup(func() { os.Remove(out.Name()) })
+	defer out.Close()
+
+	if err := r.assembleTarball(out, "https://registry.example.com", "myrepo", "", manifest); err != nil {
+		t.Fatalf("assembleTarball: %v", err)
+	}
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("seeking assembled tarball: %v", err)
+	}
+
+	entries := map[string][]byte{}
+	tr := tar.NewReader(out)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading tar entry: %v", err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("reading tar entry %s: %v", header.Name, err)
+		}
+		entries[header.Name] = data
+	}
+
+	configName := strings.TrimPrefix(manifest.Config.Digest, "sha256:") + ".json"
+	layerName := strings.TrimPrefix(manifest.Layers[0].Digest, "sha256:") + "/layer.tar"
+	if string(entries[configName]) != string(configContent) {
+		t.Errorf("config entry = %q, want %q", entries[configName], configContent)
+	}
+	if string(entries[layerName]) != string(layerContent) {
+		t.Errorf("layer entry = %q, want %q", entries[layerName], layerContent)
+	}
+	if _, ok := entries["manifest.json"]; !ok {
+		t.Error("assembled tarball missing manifest.json")
+	}
+	if _, ok := entries["repositories"]; !ok {
+		t.Error("assembled tarball missing repositories")
+	}
+}
+
+func TestAuthenticate_AnonymousAllowed(t *testing.T) {
+	getter := &scriptedGetter{getResponses: []*http.Response{newResponse(http.StatusOK, "")}}
+	r := &RegistryDownloader{getter: getter, fs: newFakeFS()}
+
+	token, err := r.authenticate("https://registry.example.com", "repo")
+	if err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	if token != "" {
+		t.Errorf("token = %q, want empty for an anonymous-allowed registry", token)
+	}
+}
+
+func TestAuthenticate_BearerChallenge(t *testing.T) {
+	getter := &scriptedGetter{
+		getResponses: []*http.Response{headerResponse(http.StatusUnauthorized, "WWW-Authenticate",
+			`Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:repo:pull"`)},
+		doResponses: []*http.Response{jsonResponse(t, http.StatusOK, map[string]string{"token": "bearer-token"})},
+	}
+	r := &RegistryDownloader{getter: getter, fs: newFakeFS()}
+
+	token, err := r.authenticate("https://registry.example.com", "repo")
+	if err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	if token != "bearer-token" {
+		t.Errorf("token = %q, want bearer-token", token)
+	}
+}
+
+func TestAuthenticate_ECRBasicChallenge(t *testing.T) {
+	t.Setenv("ECS_AGENT_REGISTRY_USERNAME", "AWS")
+	t.Setenv("ECS_AGENT_REGISTRY_PASSWORD", "ecr-password")
+
+	getter := &scriptedGetter{
+		getResponses: []*http.Response{headerResponse(http.StatusUnauthorized, "WWW-Authenticate",
+			`Basic realm="123456789.dkr.ecr.us-east-1.amazonaws.com"`)},
+		doResponses: []*http.Response{jsonResponse(t, http.StatusOK, map[string]string{"access_token": "ecr-token"})},
+	}
+	r := &RegistryDownloader{getter: getter, fs: newFakeFS()}
+
+	token, err := r.authenticate("https://123456789.dkr.ecr.us-east-1.amazonaws.com", "repo")
+	if err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	if token != "ecr-token" {
+		t.Errorf("token = %q, want ecr-token", token)
+	}
+	username, password, ok := getter.doRequests[0].BasicAuth()
+	if !ok || username != "AWS" || password != "ecr-password" {
+		t.Errorf("token exchange request BasicAuth = (%q, %q, %v), want (AWS, ecr-password, true)", username, password, ok)
+	}
+}
+
+func TestExchangeToken_PrefersTokenOverAccessToken(t *testing.T) {
+	getter := &scriptedGetter{doResponses: []*http.Response{
+		jsonResponse(t, http.StatusOK, map[string]string{"token": "t", "access_token": "a"}),
+	}}
+	r := &RegistryDownloader{getter: getter, fs: newFakeFS()}
+
+	token, err := r.exchangeToken(&registryAuth{realm: "https://auth.example.com/token"}, "repo", "", "")
+	if err != nil {
+		t.Fatalf("exchangeToken: %v", err)
+	}
+	if token != "t" {
+		t.Errorf("token = %q, want %q", token, "t")
+	}
+}
+
+// TestPull_EndToEnd exercises the full registry pull flow -- anonymous auth,
+// fetching the manifest, fetching the config and layer blobs, assembling a
+// docker-load tarball, and persisting it into the content-addressable blob
+// store -- against a scripted registry.
+func TestPull_EndToEnd(t *testing.T) {
+	cacheDir := t.TempDir()
+	t.Setenv("ECS_CACHE_DIR", cacheDir)
+	t.Setenv("ECS_SKIP_SIGNATURE_VERIFICATION", "true")
+	if err := os.MkdirAll(filepath.Join(cacheDir, "blobs", "sha256"), 0700); err != nil {
+		t.Fatalf("pre-creating blobsDir: %v", err)
+	}
+
+	configContent := []byte(`{"config":{}}`)
+	layerContent := []byte("layer contents")
+	manifest := manifestV2Schema2{
+		SchemaVersion: 2,
+		MediaType:     manifestV2MediaType,
+		Config:        descriptor{Digest: sha256Digest(configContent), Size: int64(len(configContent))},
+		Layers:        []descriptor{{Digest: sha256Digest(layerContent), Size: int64(len(layerContent))}},
+	}
+	getter := &scriptedGetter{
+		getResponses: []*http.Response{newResponse(http.StatusOK, "")}, // anonymous ping
+		doResponses: []*http.Response{
+			jsonResponse(t, http.StatusOK, manifest),
+			newResponse(http.StatusOK, string(configContent)),
+			newResponse(http.StatusOK, string(layerContent)),
+		},
+	}
+	r := &RegistryDownloader{getter: getter, fs: realFS{}}
+
+	if err := r.Pull(); err != nil {
+		t.Fatalf("Pull: %v", err)
+	}
+
+	digest, err := readRef(realFS{}, refDesired)
+	if err != nil {
+		t.Fatalf("readRef(desired): %v", err)
+	}
+	path, err := blobPath(digest)
+	if err != nil {
+		t.Fatalf("blobPath: %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Pull did not persist the assembled tarball at %s: %v", path, err)
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, "ecs-agent.tar")); err != nil {
+		t.Errorf("Pull did not populate the compat tarball: %v", err)
+	}
+}
+
+func TestParseAuthChallenge_Bearer(t *testing.T) {
+	header := `Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:agent:pull"`
+	auth, err := parseAuthChallenge(header)
+	if err != nil {
+		t.Fatalf("parseAuthChallenge: %v", err)
+	}
+	if auth.basic {
+		t.Error("expected a Bearer challenge to not be parsed as basic")
+	}
+	if auth.realm != "https://auth.example.com/token" {
+		t.Errorf("realm = %q, want %q", auth.realm, "https://auth.example.com/token")
+	}
+	if auth.service != "registry.example.com" {
+		t.Errorf("service = %q, want %q", auth.service, "registry.example.com")
+	}
+	if auth.scope != "repository:agent:pull" {
+		t.Errorf("scope = %q, want %q", auth.scope, "repository:agent:pull")
+	}
+}
+
+func TestParseAuthChallenge_Basic(t *testing.T) {
+	auth, err := parseAuthChallenge(`Basic realm="123456789.dkr.ecr.us-east-1.amazonaws.com"`)
+	if err != nil {
+		t.Fatalf("parseAuthChallenge: %v", err)
+	}
+	if !auth.basic {
+		t.Error("expected a Basic challenge to be parsed as basic")
+	}
+	if auth.realm != "123456789.dkr.ecr.us-east-1.amazonaws.com" {
+		t.Errorf("realm = %q, want the ECR host", auth.realm)
+	}
+}
+
+func TestParseAuthChallenge_Errors(t *testing.T) {
+	cases := []string{
+		"",
+		"Bearer",
+		`Bearer service="registry.example.com"`,
+	}
+	for _, header := range cases {
+		if _, err := parseAuthChallenge(header); err == nil {
+			t.Errorf("parseAuthChallenge(%q): expected an error", header)
+		}
+	}
+}
@@ -0,0 +1,330 @@
+// Copyright 2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cache
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/gob"
+	"fmt"
+	"hash"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/amazon-ecs-init/ecs-init/config"
+	log "github.com/cihub/seelog"
+)
+
+const (
+	downloadChunkSize   = 32 * 1024
+	maxDownloadRetries  = 8
+	initialRetryBackoff = 100 * time.Millisecond
+	maxRetryBackoff     = 30 * time.Second
+)
+
+// partialTarballPath is the fixed path an in-progress download is streamed
+// into, so that a retry (even across an init process restart) can find it
+// and resume with a Range request rather than starting over.
+func partialTarballPath() string {
+	return filepath.Join(config.CacheDirectory(), "ecs-agent.tar.partial")
+}
+
+func progressCheckpointPath() string {
+	return partialTarballPath() + ".progress"
+}
+
+// downloadCheckpoint is gob-encoded to progressCheckpointPath() after every
+// chunk so a restarted download can rehydrate both how much of the file it
+// already has and the running hash state, instead of rehashing from zero.
+type downloadCheckpoint struct {
+	BytesWritten int64
+	Sha256State  []byte
+	Md5State     []byte
+}
+
+func saveCheckpoint(fs fileSystem, bytesWritten int64, sha256h, md5h hash.Hash) error {
+	sha256State, err := sha256h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	md5State, err := md5h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(downloadCheckpoint{
+		BytesWritten: bytesWritten,
+		Sha256State:  sha256State,
+		Md5State:     md5State,
+	}); err != nil {
+		return err
+	}
+	return fs.WriteFile(progressCheckpointPath(), buf.Bytes(), orwPerm)
+}
+
+// loadCheckpoint restores bytesWritten and rehydrates sha256h/md5h from a
+// checkpoint left by a previous, interrupted attempt. It returns
+// bytesWritten == 0 (and leaves the hashes untouched) if no checkpoint
+// exists or it cannot be parsed, so the caller falls back to starting over.
+func loadCheckpoint(fs fileSystem, sha256h, md5h hash.Hash) int64 {
+	file, err := fs.Open(progressCheckpointPath())
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+	body, err := fs.ReadAll(file)
+	if err != nil {
+		return 0
+	}
+
+	var checkpoint downloadCheckpoint
+	if err := gob.NewDecoder(bytes.NewReader(body)).Decode(&checkpoint); err != nil {
+		log.Debugf("Ignoring unreadable download checkpoint: %v", err)
+		return 0
+	}
+	if err := sha256h.(encoding.BinaryUnmarshaler).UnmarshalBinary(checkpoint.Sha256State); err != nil {
+		log.Debugf("Ignoring download checkpoint with unreadable sha256 state: %v", err)
+		return 0
+	}
+	if err := md5h.(encoding.BinaryUnmarshaler).UnmarshalBinary(checkpoint.Md5State); err != nil {
+		log.Debugf("Ignoring download checkpoint with unreadable md5 state: %v", err)
+		sha256h.Reset()
+		return 0
+	}
+	return checkpoint.BytesWritten
+}
+
+// headPublishedTarball learns the tarball's size and whether the server
+// supports resuming a partial download via Range requests.
+func (d *Downloader) headPublishedTarball() (contentLength int64, acceptRanges bool, err error) {
+	req, err := http.NewRequest(http.MethodHead, config.AgentRemoteTarball(), nil)
+	if err != nil {
+		return 0, false, err
+	}
+	resp, err := d.getter.Do(req)
+	if err != nil {
+		return 0, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, false, fmt.Errorf("unexpected response code %d from HEAD %s", resp.StatusCode, config.AgentRemoteTarball())
+	}
+	return resp.ContentLength, resp.Header.Get("Accept-Ranges") == "bytes", nil
+}
+
+// downloadTarballResumable streams config.AgentRemoteTarball() into a fixed
+// partial-download file, updating sha256h and md5h as it goes. Transient
+// failures (a dropped connection, a network timeout, a 5xx) are retried
+// with jittered exponential backoff, resuming from where the download left
+// off via an HTTP Range request when the server advertised support for one;
+// otherwise the download (and its hashes) restart from zero. Progress, as a
+// percentage of the total size when known, is sent to d.Progress if it is
+// non-nil. The returned *os.File is positioned at the end of the download
+// and must be closed by the caller.
+func (d *Downloader) downloadTarballResumable(sha256h, md5h hash.Hash) (*os.File, error) {
+	contentLength, acceptRanges, err := d.headPublishedTarball()
+	if err != nil {
+		log.Debugf("HEAD %s failed (%v), proceeding without a known size or range support", config.AgentRemoteTarball(), err)
+	}
+
+	if err := d.fs.MkdirAll(config.CacheDirectory(), os.ModeDir|orwPerm); err != nil {
+		return nil, err
+	}
+	tempFile, err := os.OpenFile(partialTarballPath(), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	bytesWritten := loadCheckpoint(d.fs, sha256h, md5h)
+	if !acceptRanges && bytesWritten > 0 {
+		log.Debugf("Server does not support Range requests, restarting download from zero")
+		if err := restartDownload(tempFile, sha256h, md5h, &bytesWritten); err != nil {
+			tempFile.Close()
+			return nil, err
+		}
+	} else {
+		if _, err := tempFile.Seek(bytesWritten, io.SeekStart); err != nil {
+			tempFile.Close()
+			return nil, err
+		}
+		if err := tempFile.Truncate(bytesWritten); err != nil {
+			tempFile.Close()
+			return nil, err
+		}
+	}
+
+	backoff := initialRetryBackoff
+	for attempt := 1; attempt <= maxDownloadRetries; attempt++ {
+		done, retryErr := d.downloadAttempt(tempFile, sha256h, md5h, &bytesWritten, contentLength, acceptRanges)
+		if done {
+			return tempFile, nil
+		}
+		if retryErr == nil || !isTransient(retryErr) || attempt == maxDownloadRetries {
+			tempFile.Close()
+			if retryErr == nil {
+				retryErr = fmt.Errorf("download did not complete")
+			}
+			return nil, retryErr
+		}
+
+		log.Warnf("Transient error downloading Agent tarball (attempt %d/%d): %v", attempt, maxDownloadRetries, retryErr)
+		time.Sleep(jitter(backoff))
+		backoff *= 2
+		if backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+	tempFile.Close()
+	return nil, fmt.Errorf("exceeded %d attempts downloading Agent tarball", maxDownloadRetries)
+}
+
+// downloadAttempt issues a single GET (with a Range header when resuming a
+// partial download) and streams the response into tempFile, checkpointing
+// progress after every chunk. It returns done=true once the whole tarball
+// has been received.
+func (d *Downloader) downloadAttempt(tempFile *os.File, sha256h, md5h hash.Hash, bytesWritten *int64, contentLength int64, acceptRanges bool) (done bool, err error) {
+	if !acceptRanges && *bytesWritten > 0 {
+		// The server never advertised Accept-Ranges, so every attempt (not
+		// just the first one from a stale checkpoint) gets the tarball back
+		// from the start; reset the file and both hashes here so a retry
+		// after a transient error partway through this attempt doesn't
+		// append onto, and keep hashing on top of, what the previous
+		// attempt already wrote.
+		if err := restartDownload(tempFile, sha256h, md5h, bytesWritten); err != nil {
+			return false, err
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodGet, config.AgentRemoteTarball(), nil)
+	if err != nil {
+		return false, err
+	}
+	if acceptRanges && *bytesWritten > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", *bytesWritten))
+	}
+
+	resp, err := d.getter.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	resuming := acceptRanges && *bytesWritten > 0
+	wantStatus := http.StatusOK
+	if resuming {
+		wantStatus = http.StatusPartialContent
+	}
+	if resp.StatusCode != wantStatus {
+		if resuming && resp.StatusCode == http.StatusOK {
+			// The server ignored our Range header and sent the full tarball
+			// back from the start instead of continuing from *bytesWritten.
+			// Appending that onto what we already wrote (and hashing it into
+			// sha256h/md5h as though it were a continuation) would silently
+			// corrupt both, so restart the download from zero instead, the
+			// same way a server that never advertised Accept-Ranges is
+			// handled.
+			log.Debugf("Requested a Range but server responded 200 OK, restarting download from zero")
+			if err := restartDownload(tempFile, sha256h, md5h, bytesWritten); err != nil {
+				return false, err
+			}
+		} else if resp.StatusCode >= 500 {
+			return false, fmt.Errorf("unexpected response code %d", resp.StatusCode)
+		} else {
+			return false, fmt.Errorf("unrecoverable response code %d downloading Agent tarball", resp.StatusCode)
+		}
+	}
+
+	buf := make([]byte, downloadChunkSize)
+	multiHash := io.MultiWriter(sha256h, md5h)
+	for {
+		n, readErr := resp.Body.Read(buf)
+		if n > 0 {
+			if _, writeErr := tempFile.Write(buf[:n]); writeErr != nil {
+				return false, writeErr
+			}
+			if _, writeErr := multiHash.Write(buf[:n]); writeErr != nil {
+				return false, writeErr
+			}
+			*bytesWritten += int64(n)
+			if err := saveCheckpoint(d.fs, *bytesWritten, sha256h, md5h); err != nil {
+				log.Debugf("Could not persist download checkpoint: %v", err)
+			}
+			d.reportProgress(*bytesWritten, contentLength)
+		}
+		if readErr == io.EOF {
+			if contentLength > 0 && *bytesWritten != contentLength {
+				return false, io.ErrUnexpectedEOF
+			}
+			return true, nil
+		}
+		if readErr != nil {
+			return false, readErr
+		}
+	}
+}
+
+// restartDownload discards whatever has been written to tempFile so far and
+// resets bytesWritten and both hashes to zero, so the caller's read loop
+// re-populates the file from the start of the (non-partial) response body.
+func restartDownload(tempFile *os.File, sha256h, md5h hash.Hash, bytesWritten *int64) error {
+	if _, err := tempFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := tempFile.Truncate(0); err != nil {
+		return err
+	}
+	sha256h.Reset()
+	md5h.Reset()
+	*bytesWritten = 0
+	return nil
+}
+
+// reportProgress sends the current percent-complete to d.Progress, if set,
+// without blocking if nothing is receiving.
+func (d *Downloader) reportProgress(bytesWritten, contentLength int64) {
+	if d.Progress == nil || contentLength <= 0 {
+		return
+	}
+	percent := int(bytesWritten * 100 / contentLength)
+	select {
+	case d.Progress <- percent:
+	default:
+	}
+}
+
+// isTransient reports whether err represents a failure worth retrying:
+// an unexpectedly closed connection, a network-level error (timeout,
+// connection reset), or a 5xx response.
+func isTransient(err error) bool {
+	if err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	return strings.Contains(err.Error(), "unexpected response code 5")
+}
+
+// jitter returns d plus up to 20% random jitter, so concurrently retrying
+// instances don't all hammer the server in lockstep.
+func jitter(d time.Duration) time.Duration {
+	return d + time.Duration(rand.Int63n(int64(d)/5+1))
+}
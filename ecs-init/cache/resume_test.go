@@ -0,0 +1,230 @@
+// Copyright 2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cache
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+// fakeGetter replays a fixed queue of responses to successive Do calls, so
+// tests can script a server's behavior across retries without a real
+// network round trip.
+type fakeGetter struct {
+	responses []*http.Response
+	requests  []*http.Request
+}
+
+func (g *fakeGetter) Get(url string) (*http.Response, error) {
+	return nil, fmt.Errorf("fakeGetter: Get is not used by downloadAttempt")
+}
+
+func (g *fakeGetter) Do(req *http.Request) (*http.Response, error) {
+	g.requests = append(g.requests, req)
+	if len(g.responses) == 0 {
+		return nil, fmt.Errorf("fakeGetter: no more responses queued")
+	}
+	resp := g.responses[0]
+	g.responses = g.responses[1:]
+	return resp, nil
+}
+
+func newResponse(status int, body string) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+func newTempFileWithContent(t *testing.T, content string) *os.File {
+	t.Helper()
+	f, err := os.CreateTemp("", "resume-test")
+	if err != nil {
+		t.Fatalf("CreateTemp: %v", err)
+	}
+	t.Cleanup(func() { os.Remove(f.Name()) })
+	if content != "" {
+		if _, err := f.WriteString(content); err != nil {
+			t.Fatalf("writing initial content: %v", err)
+		}
+	}
+	return f
+}
+
+// TestDownloadAttempt_ServerIgnoresRange verifies that a server responding
+// 200 OK to a Range request (rather than 206 Partial Content) is treated as
+// not actually resuming: the partial file and hash state are discarded and
+// the download restarts from zero using the full body the server sent,
+// instead of corrupting the file by appending the full body onto the
+// already-written prefix.
+func TestDownloadAttempt_ServerIgnoresRange(t *testing.T) {
+	const prefix = "already-downloaded-"
+	const full = "the-entire-tarball-contents"
+
+	tempFile := newTempFileWithContent(t, prefix)
+	bytesWritten := int64(len(prefix))
+	sha256h, md5h := sha256.New(), md5.New()
+	sha256h.Write([]byte(prefix))
+	md5h.Write([]byte(prefix))
+
+	getter := &fakeGetter{responses: []*http.Response{newResponse(http.StatusOK, full)}}
+	d := &Downloader{getter: getter, fs: newFakeFS()}
+
+	done, err := d.downloadAttempt(tempFile, sha256h, md5h, &bytesWritten, -1, true)
+	if err != nil {
+		t.Fatalf("downloadAttempt: %v", err)
+	}
+	if !done {
+		t.Fatal("expected downloadAttempt to report done after a full restart")
+	}
+	if bytesWritten != int64(len(full)) {
+		t.Errorf("bytesWritten = %d, want %d", bytesWritten, len(full))
+	}
+
+	got, err := os.ReadFile(tempFile.Name())
+	if err != nil {
+		t.Fatalf("reading temp file: %v", err)
+	}
+	if string(got) != full {
+		t.Errorf("file contents = %q, want %q (prefix must not be retained)", got, full)
+	}
+
+	wantSum := fmt.Sprintf("%x", sha256.Sum256([]byte(full)))
+	if gotSum := fmt.Sprintf("%x", sha256h.Sum(nil)); gotSum != wantSum {
+		t.Errorf("sha256 = %s, want %s (must not include the discarded prefix)", gotSum, wantSum)
+	}
+
+	if got := getter.requests[0].Header.Get("Range"); got != fmt.Sprintf("bytes=%d-", len(prefix)) {
+		t.Errorf("Range header = %q, want a request for the unwritten suffix", got)
+	}
+}
+
+// TestDownloadAttempt_ResumesOnPartialContent verifies the normal resume
+// path: a 206 response is appended after the already-written prefix and
+// folded into the existing hash state rather than replacing it.
+func TestDownloadAttempt_ResumesOnPartialContent(t *testing.T) {
+	const prefix = "already-downloaded-"
+	const suffix = "and-the-rest"
+	full := prefix + suffix
+
+	tempFile := newTempFileWithContent(t, prefix)
+	if _, err := tempFile.Seek(0, io.SeekEnd); err != nil {
+		t.Fatalf("seeking to end of prefix: %v", err)
+	}
+	bytesWritten := int64(len(prefix))
+	sha256h, md5h := sha256.New(), md5.New()
+	sha256h.Write([]byte(prefix))
+	md5h.Write([]byte(prefix))
+
+	getter := &fakeGetter{responses: []*http.Response{newResponse(http.StatusPartialContent, suffix)}}
+	d := &Downloader{getter: getter, fs: newFakeFS()}
+
+	done, err := d.downloadAttempt(tempFile, sha256h, md5h, &bytesWritten, int64(len(full)), true)
+	if err != nil {
+		t.Fatalf("downloadAttempt: %v", err)
+	}
+	if !done {
+		t.Fatal("expected downloadAttempt to report done")
+	}
+	if bytesWritten != int64(len(full)) {
+		t.Errorf("bytesWritten = %d, want %d", bytesWritten, len(full))
+	}
+
+	got, err := os.ReadFile(tempFile.Name())
+	if err != nil {
+		t.Fatalf("reading temp file: %v", err)
+	}
+	if string(got) != full {
+		t.Errorf("file contents = %q, want %q", got, full)
+	}
+
+	wantSum := fmt.Sprintf("%x", sha256.Sum256([]byte(full)))
+	if gotSum := fmt.Sprintf("%x", sha256h.Sum(nil)); gotSum != wantSum {
+		t.Errorf("sha256 = %s, want %s", gotSum, wantSum)
+	}
+}
+
+// TestDownloadAttempt_ResetsStateWhenRangeUnsupported verifies that an
+// attempt made with acceptRanges==false starts by discarding whatever a
+// previous, interrupted attempt already wrote, rather than appending the
+// fresh 200 response body onto it. This is the state a retry loop is in
+// after a transient error cuts off a non-resumable download partway
+// through: the server will send the whole tarball again from byte zero,
+// so tempFile and both hashes must be reset to zero before it arrives.
+func TestDownloadAttempt_ResetsStateWhenRangeUnsupported(t *testing.T) {
+	const stalePartial = "bytes-left-over-from-an-interrupted-attempt"
+	const full = "the-entire-tarball-contents"
+
+	tempFile := newTempFileWithContent(t, stalePartial)
+	bytesWritten := int64(len(stalePartial))
+	sha256h, md5h := sha256.New(), md5.New()
+	sha256h.Write([]byte(stalePartial))
+	md5h.Write([]byte(stalePartial))
+
+	getter := &fakeGetter{responses: []*http.Response{newResponse(http.StatusOK, full)}}
+	d := &Downloader{getter: getter, fs: newFakeFS()}
+
+	done, err := d.downloadAttempt(tempFile, sha256h, md5h, &bytesWritten, -1, false)
+	if err != nil {
+		t.Fatalf("downloadAttempt: %v", err)
+	}
+	if !done {
+		t.Fatal("expected downloadAttempt to report done")
+	}
+	if bytesWritten != int64(len(full)) {
+		t.Errorf("bytesWritten = %d, want %d", bytesWritten, len(full))
+	}
+
+	got, err := os.ReadFile(tempFile.Name())
+	if err != nil {
+		t.Fatalf("reading temp file: %v", err)
+	}
+	if string(got) != full {
+		t.Errorf("file contents = %q, want %q (stale partial bytes must not be retained)", got, full)
+	}
+
+	wantSum := fmt.Sprintf("%x", sha256.Sum256([]byte(full)))
+	if gotSum := fmt.Sprintf("%x", sha256h.Sum(nil)); gotSum != wantSum {
+		t.Errorf("sha256 = %s, want %s (must not include the discarded stale bytes)", gotSum, wantSum)
+	}
+
+	if got := getter.requests[0].Header.Get("Range"); got != "" {
+		t.Errorf("Range header = %q, want none (server never advertised Accept-Ranges)", got)
+	}
+}
+
+// TestDownloadAttempt_UnrecoverableStatus verifies a 4xx response while
+// resuming is rejected outright rather than accepted as a fresh download.
+func TestDownloadAttempt_UnrecoverableStatus(t *testing.T) {
+	tempFile := newTempFileWithContent(t, "partial")
+	bytesWritten := int64(len("partial"))
+	sha256h, md5h := sha256.New(), md5.New()
+
+	getter := &fakeGetter{responses: []*http.Response{newResponse(http.StatusRequestedRangeNotSatisfiable, "")}}
+	d := &Downloader{getter: getter, fs: newFakeFS()}
+
+	done, err := d.downloadAttempt(tempFile, sha256h, md5h, &bytesWritten, -1, true)
+	if err == nil {
+		t.Fatal("expected an error for an unrecoverable status code")
+	}
+	if done {
+		t.Error("expected done=false on error")
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package config centralizes the environment variables and on-disk paths
+// ecs-init's cache and signature verification packages are configured
+// through, so operators have one place to look and the rest of the codebase
+// never reads os.Getenv directly.
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	cacheDirectoryEnvVar  = "ECS_CACHE_DIR"
+	defaultCacheDirectory = "/var/cache/ecs"
+
+	agentRemoteTarballEnvVar  = "ECS_AGENT_TARBALL_URL"
+	defaultAgentRemoteTarball = "https://s3.amazonaws.com/amazon-ecs-agent/ecs-agent-latest.tar"
+
+	agentRegistryEndpointEnvVar    = "ECS_AGENT_REGISTRY_ENDPOINT"
+	agentRegistryRepositoryEnvVar  = "ECS_AGENT_REGISTRY_REPOSITORY"
+	defaultAgentRegistryRepository = "amazon/amazon-ecs-agent"
+	agentRegistryTagEnvVar         = "ECS_AGENT_REGISTRY_TAG"
+	defaultAgentRegistryTag        = "latest"
+	agentRegistryUsernameEnvVar    = "ECS_AGENT_REGISTRY_USERNAME"
+	agentRegistryPasswordEnvVar    = "ECS_AGENT_REGISTRY_PASSWORD"
+
+	cacheMaxAgeEnvVar  = "ECS_CACHE_MAX_AGE"
+	cacheMaxSizeEnvVar = "ECS_CACHE_MAX_SIZE"
+
+	skipSignatureVerificationEnvVar = "ECS_SKIP_SIGNATURE_VERIFICATION"
+
+	signatureSchemeEnvVar  = "ECS_AGENT_SIGNATURE_SCHEME"
+	defaultSignatureScheme = "openpgp"
+
+	trustedKeysDirEnvVar  = "ECS_AGENT_TRUSTED_KEYS_DIR"
+	defaultTrustedKeysDir = "/etc/ecs/keys"
+)
+
+// CacheDirectory returns the directory ecs-init keeps its on-disk cache in:
+// the Agent tarball and its content-addressable blobs, the cache state
+// marker, the desired-image locator file, and the filecache subsystem's
+// named caches. It defaults to /var/cache/ecs and is overridden by
+// ECS_CACHE_DIR.
+func CacheDirectory() string {
+	if dir := os.Getenv(cacheDirectoryEnvVar); dir != "" {
+		return dir
+	}
+	return defaultCacheDirectory
+}
+
+// CacheState returns the path of the marker file IsAgentCached checks to
+// decide whether a cached Agent tarball is present.
+func CacheState() string {
+	return filepath.Join(CacheDirectory(), "cache-state")
+}
+
+// AgentTarball returns the fixed path the Agent tarball is loaded from,
+// whether downloaded from a registry, the S3 tarball flow, or restored from
+// the content-addressable blob store's compatibility shim.
+func AgentTarball() string {
+	return filepath.Join(CacheDirectory(), "ecs-agent.tar")
+}
+
+// DesiredImageLocatorFile returns the path of the file naming the Agent
+// image LoadDesiredAgent should load, relative to CacheDirectory().
+func DesiredImageLocatorFile() string {
+	return filepath.Join(CacheDirectory(), "desired-image")
+}
+
+// AgentRemoteTarball returns the URL the Agent tarball is published at,
+// overridden by ECS_AGENT_TARBALL_URL.
+func AgentRemoteTarball() string {
+	if url := os.Getenv(agentRemoteTarballEnvVar); url != "" {
+		return url
+	}
+	return defaultAgentRemoteTarball
+}
+
+// AgentRemoteTarballMD5 returns the URL of the legacy md5sum published
+// alongside AgentRemoteTarball().
+func AgentRemoteTarballMD5() string {
+	return AgentRemoteTarball() + ".md5"
+}
+
+// AgentRegistryEndpoint returns the OCI/Docker registry endpoint to pull the
+// Agent image from, e.g. "https://123456789.dkr.ecr.us-east-1.amazonaws.com".
+// An empty string (the default, set via ECS_AGENT_REGISTRY_ENDPOINT) means
+// registry pull is disabled and DownloadAgent falls back to the S3 tarball.
+func AgentRegistryEndpoint() string {
+	return os.Getenv(agentRegistryEndpointEnvVar)
+}
+
+// AgentRegistryRepository returns the repository name to pull the Agent
+// image from within AgentRegistryEndpoint(), overridden by
+// ECS_AGENT_REGISTRY_REPOSITORY.
+func AgentRegistryRepository() string {
+	if repo := os.Getenv(agentRegistryRepositoryEnvVar); repo != "" {
+		return repo
+	}
+	return defaultAgentRegistryRepository
+}
+
+// AgentRegistryTag returns the tag to pull within AgentRegistryRepository(),
+// overridden by ECS_AGENT_REGISTRY_TAG.
+func AgentRegistryTag() string {
+	if tag := os.Getenv(agentRegistryTagEnvVar); tag != "" {
+		return tag
+	}
+	return defaultAgentRegistryTag
+}
+
+// AgentRegistryECRAuth returns the basic auth credentials to exchange for a
+// bearer token when the registry challenges with Basic (as ECR does),
+// sourced from the result of an operator-run ecr:GetAuthorizationToken and
+// passed through ECS_AGENT_REGISTRY_USERNAME/ECS_AGENT_REGISTRY_PASSWORD. An
+// empty username means anonymous pull is attempted instead.
+func AgentRegistryECRAuth() (username, password string, err error) {
+	return os.Getenv(agentRegistryUsernameEnvVar), os.Getenv(agentRegistryPasswordEnvVar), nil
+}
+
+// AgentRemoteTarballSHA256 returns the URL of the sha256sum published
+// alongside AgentRemoteTarball(), preferred over AgentRemoteTarballMD5()
+// when present.
+func AgentRemoteTarballSHA256() string {
+	return AgentRemoteTarball() + ".sha256"
+}
+
+// CacheMaxAge returns the maximum age a filecache entry may reach before
+// Prune evicts it, parsed from ECS_CACHE_MAX_AGE (e.g. "168h"). A zero
+// Duration (the default, or an unparseable value) means entries are never
+// evicted on age alone.
+func CacheMaxAge() time.Duration {
+	age, err := time.ParseDuration(os.Getenv(cacheMaxAgeEnvVar))
+	if err != nil {
+		return 0
+	}
+	return age
+}
+
+// CacheMaxSizeBytes returns the size a cache may grow to before Prune starts
+// evicting its oldest unpinned entries, parsed from ECS_CACHE_MAX_SIZE. Zero
+// (the default, or an unparseable value) means the cache is unbounded.
+func CacheMaxSizeBytes() int64 {
+	size, err := strconv.ParseInt(os.Getenv(cacheMaxSizeEnvVar), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return size
+}
+
+// AgentRemoteTarballSig returns the URL of the detached signature published
+// alongside AgentRemoteTarball(), verified by the sigverify package before
+// the download is accepted.
+func AgentRemoteTarballSig() string {
+	return AgentRemoteTarball() + ".sig"
+}
+
+// SkipSignatureVerification reports whether ECS_SKIP_SIGNATURE_VERIFICATION
+// is set, bypassing sigverify's check of the Agent tarball's detached
+// signature. It exists as an escape hatch for environments that cannot
+// reach the key distribution point; operators should prefer leaving
+// signature verification enabled.
+func SkipSignatureVerification() bool {
+	skip, _ := strconv.ParseBool(os.Getenv(skipSignatureVerificationEnvVar))
+	return skip
+}
+
+// SignatureScheme returns the sigverify.Scheme to verify the Agent
+// signature with, overridden by ECS_AGENT_SIGNATURE_SCHEME. It defaults to
+// "openpgp".
+func SignatureScheme() string {
+	if scheme := os.Getenv(signatureSchemeEnvVar); scheme != "" {
+		return scheme
+	}
+	return defaultSignatureScheme
+}
+
+// TrustedKeys reads every file in the trusted keys directory (defaulting to
+// /etc/ecs/keys, overridden by ECS_AGENT_TRUSTED_KEYS_DIR) and returns their
+// raw contents, each expected to be a PEM-encoded ECDSA public key (cosign
+// scheme) or an armored OpenPGP public keyring (openpgp scheme). A missing
+// directory is treated as zero trusted keys rather than an error, since
+// sigverify.Verify already rejects an empty key set with a clear message.
+func TrustedKeys() ([][]byte, error) {
+	dir := os.Getenv(trustedKeysDirEnvVar)
+	if dir == "" {
+		dir = defaultTrustedKeysDir
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("reading trusted keys directory %s: %v", dir, err)
+	}
+
+	var keys [][]byte
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("reading trusted key %s: %v", entry.Name(), err)
+		}
+		keys = append(keys, data)
+	}
+	return keys, nil
+}
@@ -0,0 +1,160 @@
+// Copyright 2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package sigverify verifies the detached signature published alongside the
+// Agent tarball against the keys ecs-init trusts, so a compromised or
+// mirror-tampered download (or a cached tarball tampered with between
+// reboots) is rejected before it is ever loaded into Docker.
+package sigverify
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/aws/amazon-ecs-init/ecs-init/config"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+// Scheme identifies the signature format a tarball is expected to be
+// published with, as selected by config.SignatureScheme().
+type Scheme string
+
+const (
+	// SchemeOpenPGP verifies an OpenPGP clearsigned checksum file.
+	SchemeOpenPGP Scheme = "openpgp"
+	// SchemeCosign verifies a cosign-style raw ECDSA signature over the
+	// sha256 digest of the tarball.
+	SchemeCosign Scheme = "cosign"
+)
+
+// Verify checks sig against digest (the "sha256:<hex>" digest of the
+// downloaded or cached tarball) using the scheme and trusted keys from
+// config. It returns a non-nil error if the signature is missing, malformed,
+// or does not verify against any trusted key.
+func Verify(digest string, sig []byte) error {
+	if len(sig) == 0 {
+		return fmt.Errorf("sigverify: signature is empty")
+	}
+
+	keys, err := config.TrustedKeys()
+	if err != nil {
+		return fmt.Errorf("sigverify: loading trusted keys: %v", err)
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("sigverify: no trusted keys configured")
+	}
+
+	switch Scheme(config.SignatureScheme()) {
+	case SchemeCosign:
+		return verifyCosign(digest, sig, keys)
+	case SchemeOpenPGP:
+		return verifyOpenPGPClearsign(digest, sig, keys)
+	default:
+		return fmt.Errorf("sigverify: unknown signature scheme %q", config.SignatureScheme())
+	}
+}
+
+// verifyCosign verifies sig as an ASN.1 DER ECDSA signature over the raw
+// sha256 digest bytes, checked against every PEM-encoded P-256 public key in
+// keys until one matches.
+func verifyCosign(digest string, sig []byte, keys [][]byte) error {
+	digestBytes, err := digestToBytes(digest)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for _, keyPEM := range keys {
+		pub, err := parseECDSAPublicKey(keyPEM)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if ecdsa.VerifyASN1(pub, digestBytes, sig) {
+			return nil
+		}
+	}
+	if lastErr != nil {
+		return fmt.Errorf("sigverify: no trusted key verified the cosign signature (last error: %v)", lastErr)
+	}
+	return fmt.Errorf("sigverify: no trusted key verified the cosign signature")
+}
+
+func parseECDSAPublicKey(keyPEM []byte) (*ecdsa.PublicKey, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("not a PEM-encoded key")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ecdsaPub, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("key is not an ECDSA public key")
+	}
+	return ecdsaPub, nil
+}
+
+func digestToBytes(digest string) ([]byte, error) {
+	const prefix = "sha256:"
+	if len(digest) <= len(prefix) || digest[:len(prefix)] != prefix {
+		return nil, fmt.Errorf("unsupported digest %q", digest)
+	}
+	sum, err := hex.DecodeString(digest[len(prefix):])
+	if err != nil {
+		return nil, fmt.Errorf("parsing digest %q: %v", digest, err)
+	}
+	if len(sum) != sha256.Size {
+		return nil, fmt.Errorf("digest %q is not a sha256 digest", digest)
+	}
+	return sum, nil
+}
+
+// verifyOpenPGPClearsign verifies sig as an OpenPGP clearsigned checksum
+// file (e.g. `gpg --clearsign` over a line of the form "<sha256sum>  agent.tar")
+// whose embedded digest must match digest, signed by one of the armored
+// keyrings in keys.
+func verifyOpenPGPClearsign(digest string, sig []byte, keys [][]byte) error {
+	var keyring openpgp.EntityList
+	for _, keyPEM := range keys {
+		entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(keyPEM))
+		if err != nil {
+			continue
+		}
+		keyring = append(keyring, entities...)
+	}
+	if len(keyring) == 0 {
+		return fmt.Errorf("sigverify: no trusted OpenPGP keys could be parsed")
+	}
+
+	block, _ := clearsign.Decode(sig)
+	if block == nil {
+		return fmt.Errorf("sigverify: not a clearsigned message")
+	}
+	if _, err := openpgp.CheckDetachedSignature(keyring, bytes.NewReader(block.Bytes), block.ArmoredSignature.Body); err != nil {
+		return fmt.Errorf("sigverify: clearsign signature did not verify: %v", err)
+	}
+
+	wantSum := digest[len("sha256:"):]
+	if !bytes.Contains(block.Plaintext, []byte(wantSum)) {
+		return fmt.Errorf("sigverify: clearsigned checksum file does not reference digest %s", digest)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+// Copyright 2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package sigverify
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+const testDigest = "sha256:00000000000000000000000000000000000000000000000000000000000000aa"
+
+func generateECDSAKeyPEM(t *testing.T) (*ecdsa.PrivateKey, []byte) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatalf("marshaling public key: %v", err)
+	}
+	return priv, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func TestDigestToBytes(t *testing.T) {
+	if _, err := digestToBytes(testDigest); err != nil {
+		t.Errorf("valid digest rejected: %v", err)
+	}
+	if _, err := digestToBytes("md5:aabbcc"); err == nil {
+		t.Error("expected error for unsupported algorithm prefix")
+	}
+	if _, err := digestToBytes("sha256:not-hex"); err == nil {
+		t.Error("expected error for malformed hex digest")
+	}
+}
+
+func TestVerifyCosign(t *testing.T) {
+	priv, pubPEM := generateECDSAKeyPEM(t)
+	digestBytes, err := digestToBytes(testDigest)
+	if err != nil {
+		t.Fatalf("digestToBytes: %v", err)
+	}
+	sig, err := ecdsa.SignASN1(rand.Reader, priv, digestBytes)
+	if err != nil {
+		t.Fatalf("signing digest: %v", err)
+	}
+
+	if err := verifyCosign(testDigest, sig, [][]byte{pubPEM}); err != nil {
+		t.Errorf("verifyCosign with the matching key and digest: %v", err)
+	}
+
+	otherPriv, _ := generateECDSAKeyPEM(t)
+	wrongSig, err := ecdsa.SignASN1(rand.Reader, otherPriv, digestBytes)
+	if err != nil {
+		t.Fatalf("signing digest with other key: %v", err)
+	}
+	if err := verifyCosign(testDigest, wrongSig, [][]byte{pubPEM}); err == nil {
+		t.Error("expected verifyCosign to reject a signature from an untrusted key")
+	}
+}
+
+func generateOpenPGPEntity(t *testing.T) (*openpgp.Entity, []byte) {
+	t.Helper()
+	entity, err := openpgp.NewEntity("Test Signer", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatalf("generating openpgp entity: %v", err)
+	}
+
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatalf("encoding armor: %v", err)
+	}
+	if err := entity.Serialize(w); err != nil {
+		t.Fatalf("serializing public key: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("closing armor writer: %v", err)
+	}
+	return entity, buf.Bytes()
+}
+
+func clearsignMessage(t *testing.T, entity *openpgp.Entity, message string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := clearsign.Encode(&buf, entity.PrivateKey, nil)
+	if err != nil {
+		t.Fatalf("encoding clearsign message: %v", err)
+	}
+	if _, err := w.Write([]byte(message)); err != nil {
+		t.Fatalf("writing clearsign message: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("closing clearsign writer: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestVerifyOpenPGPClearsign(t *testing.T) {
+	entity, pubArmored := generateOpenPGPEntity(t)
+	checksumLine := testDigest[len("sha256:"):] + "  agent.tar\n"
+	sig := clearsignMessage(t, entity, checksumLine)
+
+	if err := verifyOpenPGPClearsign(testDigest, sig, [][]byte{pubArmored}); err != nil {
+		t.Errorf("verifyOpenPGPClearsign with a matching signature and digest: %v", err)
+	}
+
+	otherEntity, otherPubArmored := generateOpenPGPEntity(t)
+	_ = otherEntity
+	if err := verifyOpenPGPClearsign(testDigest, sig, [][]byte{otherPubArmored}); err == nil {
+		t.Error("expected verifyOpenPGPClearsign to reject a signature from an untrusted key")
+	}
+
+	mismatchedSig := clearsignMessage(t, entity, "deadbeef  agent.tar\n")
+	if err := verifyOpenPGPClearsign(testDigest, mismatchedSig, [][]byte{pubArmored}); err == nil {
+		t.Error("expected verifyOpenPGPClearsign to reject a checksum file referencing a different digest")
+	}
+}